@@ -0,0 +1,455 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a GameStore and EventBus that keeps everything in process.
+// It is meant for single-node deployments and tests.
+type MemoryStore struct {
+	mu       sync.Mutex
+	games    map[string]memoryEntry
+	presence map[string]map[string]int64
+	events   map[string]*memoryEventLog
+	// chat holds each game's chat log per room, muted its users who muted it
+	chat  map[string]map[string][][]byte
+	muted map[string]map[string]bool
+	// chatCounts holds each user's chat rate window, by game and user
+	chatCounts map[string]chatCount
+	// seeks are the lobby's open seeks by id
+	seeks map[string]LobbySeek
+	// queue holds the users waiting in any matchmaking queue, by user id
+	queue map[string]QueueEntry
+}
+
+// memoryEventLog is a game's sequence counter and its most recent events.
+// notify is closed, and replaced, whenever an event is appended.
+type memoryEventLog struct {
+	seq    int64
+	events [][]byte
+	notify chan struct{}
+}
+
+type memoryEntry struct {
+	cache     RedisCache
+	expiresAt time.Time // zero means no expiry
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		games:      make(map[string]memoryEntry),
+		presence:   make(map[string]map[string]int64),
+		events:     make(map[string]*memoryEventLog),
+		chat:       make(map[string]map[string][][]byte),
+		muted:      make(map[string]map[string]bool),
+		chatCounts: make(map[string]chatCount),
+		seeks:      make(map[string]LobbySeek),
+		queue:      make(map[string]QueueEntry),
+	}
+}
+
+func (s *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// get returns the live entry for gameId. Callers must hold s.mu.
+func (s *MemoryStore) get(gameId string) (memoryEntry, bool) {
+	entry, ok := s.games[gameId]
+	if !ok {
+		return memoryEntry{}, false
+	}
+	if !entry.expiresAt.IsZero() && time.Now().After(entry.expiresAt) {
+		delete(s.games, gameId)
+		delete(s.presence, gameId)
+		delete(s.chat, gameId)
+		delete(s.muted, gameId)
+		if eventLog := s.events[gameId]; eventLog != nil {
+			close(eventLog.notify)
+			delete(s.events, gameId)
+		}
+		return memoryEntry{}, false
+	}
+	return entry, true
+}
+
+func (s *MemoryStore) GetVal(ctx context.Context, gameId string) (*RedisCache, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.get(gameId)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	cache := entry.cache.clone()
+	return &cache, nil
+}
+
+func (s *MemoryStore) CreateGame(ctx context.Context, gameId string, cache RedisCache, exp *time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := memoryEntry{cache: cache.clone()}
+	if exp != nil {
+		entry.expiresAt = time.Now().Add(*exp)
+	} else if current, ok := s.get(gameId); ok {
+		entry.expiresAt = current.expiresAt
+	}
+	s.games[gameId] = entry
+	return nil
+}
+
+func (s *MemoryStore) DeleteGame(ctx context.Context, gameId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.games, gameId)
+	return nil
+}
+
+func (s *MemoryStore) UpdateVal(ctx context.Context, gameId string, updates UpdateOptions, exp *time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.get(gameId)
+	if !ok {
+		return ErrNotFound
+	}
+
+	if updates.Version != nil && *updates.Version != entry.cache.Version {
+		return &ConflictError{GameId: gameId, Version: entry.cache.Version}
+	}
+
+	updates.merge(&entry.cache)
+	entry.cache = entry.cache.clone()
+	entry.cache.Version++
+	if exp != nil {
+		entry.expiresAt = time.Now().Add(*exp)
+	}
+	s.games[gameId] = entry
+	return nil
+}
+
+func (s *MemoryStore) AddPresence(ctx context.Context, gameId string, color string, delta int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.presence[gameId] == nil {
+		s.presence[gameId] = make(map[string]int64)
+	}
+	s.presence[gameId][color] += delta
+	return s.presence[gameId][color], nil
+}
+
+func (s *MemoryStore) GetPresence(ctx context.Context, gameId string) (map[string]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.presence[gameId]), nil
+}
+
+func (s *MemoryStore) AppendChat(ctx context.Context, gameId string, room string, msg []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.chat[gameId] == nil {
+		s.chat[gameId] = make(map[string][][]byte)
+	}
+	chatLog := append(s.chat[gameId][room], msg)
+	if len(chatLog) > chatLogSize {
+		chatLog = chatLog[len(chatLog)-chatLogSize:]
+	}
+	s.chat[gameId][room] = chatLog
+	return nil
+}
+
+func (s *MemoryStore) ChatLog(ctx context.Context, gameId string, room string) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]byte(nil), s.chat[gameId][room]...), nil
+}
+
+func (s *MemoryStore) SetChatMuted(ctx context.Context, gameId string, userId string, muted bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.muted[gameId] == nil {
+		s.muted[gameId] = make(map[string]bool)
+	}
+	if muted {
+		s.muted[gameId][userId] = true
+	} else {
+		delete(s.muted[gameId], userId)
+	}
+	return nil
+}
+
+func (s *MemoryStore) ChatMuted(ctx context.Context, gameId string, userId string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.muted[gameId][userId], nil
+}
+
+// chatCount is how many messages were sent in a window ending at endsAt
+type chatCount struct {
+	sent   int64
+	endsAt time.Time
+}
+
+func (s *MemoryStore) CountChat(ctx context.Context, gameId string, userId string, window time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := gameId + ":" + userId
+	now := time.Now()
+	count := s.chatCounts[key]
+	if !now.Before(count.endsAt) {
+		count = chatCount{endsAt: now.Add(window)}
+	}
+	count.sent++
+	s.chatCounts[key] = count
+	return count.sent, nil
+}
+
+func (s *MemoryStore) AddSeek(ctx context.Context, seek LobbySeek) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seeks[seek.Seek.Id] = seek
+	return nil
+}
+
+func (s *MemoryStore) TakeSeek(ctx context.Context, id string) (*LobbySeek, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seek, ok := s.seeks[id]
+	if !ok {
+		return nil, ErrSeekNotFound
+	}
+	delete(s.seeks, id)
+	return &seek, nil
+}
+
+func (s *MemoryStore) ListSeeks(ctx context.Context) ([]LobbySeek, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seeks := slices.Collect(maps.Values(s.seeks))
+	sortSeeks(seeks)
+	return seeks, nil
+}
+
+func (s *MemoryStore) RefreshSeeks(ctx context.Context, ids []string, nowMs int64, ttl time.Duration) ([]LobbySeek, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, id := range ids {
+		if seek, ok := s.seeks[id]; ok {
+			seek.SeenAtMs = nowMs
+			s.seeks[id] = seek
+		}
+	}
+	expired := []LobbySeek{}
+	for id, seek := range s.seeks {
+		if seek.SeenAtMs < nowMs-ttl.Milliseconds() {
+			delete(s.seeks, id)
+			expired = append(expired, seek)
+		}
+	}
+	return expired, nil
+}
+
+func (s *MemoryStore) JoinQueue(ctx context.Context, entry QueueEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.queue[entry.UserId] = entry
+	return nil
+}
+
+func (s *MemoryStore) LeaveQueue(ctx context.Context, timeControl string, userId string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.queue[userId]
+	if !ok || (timeControl != "" && entry.TimeControl != timeControl) {
+		return false, nil
+	}
+	delete(s.queue, userId)
+	return true, nil
+}
+
+func (s *MemoryStore) RefreshQueue(ctx context.Context, timeControl string, userIds []string, nowMs int64, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, userId := range userIds {
+		if entry, ok := s.queue[userId]; ok && entry.TimeControl == timeControl {
+			entry.SeenAtMs = nowMs
+			s.queue[userId] = entry
+		}
+	}
+	for userId, entry := range s.queue {
+		if entry.SeenAtMs < nowMs-ttl.Milliseconds() {
+			delete(s.queue, userId)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) TakeQueuedPair(ctx context.Context, timeControl string, userA string, userB string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, waitingA := s.queue[userA]
+	b, waitingB := s.queue[userB]
+	if !waitingA || !waitingB || a.TimeControl != timeControl || b.TimeControl != timeControl {
+		return false, nil
+	}
+	delete(s.queue, userA)
+	delete(s.queue, userB)
+	return true, nil
+}
+
+func (s *MemoryStore) ListQueue(ctx context.Context, timeControl string) ([]QueueEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := []QueueEntry{}
+	for _, entry := range s.queue {
+		if entry.TimeControl == timeControl {
+			entries = append(entries, entry)
+		}
+	}
+	sortQueue(entries)
+	return entries, nil
+}
+
+func (s *MemoryStore) PublishGameEvent(ctx context.Context, gameId string, event []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	eventLog := s.eventLog(gameId)
+	eventLog.seq++
+	event = append(fmt.Appendf(nil, `{"seq":%d,`, eventLog.seq), event[1:]...)
+	eventLog.events = append(eventLog.events, event)
+	if len(eventLog.events) > eventLogSize {
+		eventLog.events = eventLog.events[len(eventLog.events)-eventLogSize:]
+	}
+
+	// Wake every subscriber waiting for this game
+	close(eventLog.notify)
+	eventLog.notify = make(chan struct{})
+	return nil
+}
+
+// eventLog returns the log for gameId, creating it if needed. Callers must hold s.mu.
+func (s *MemoryStore) eventLog(gameId string) *memoryEventLog {
+	eventLog := s.events[gameId]
+	if eventLog == nil {
+		eventLog = &memoryEventLog{notify: make(chan struct{})}
+		s.events[gameId] = eventLog
+	}
+	return eventLog
+}
+
+// pendingEvents returns the logged events of gameId numbered above afterSeq,
+// the number of the last one, and a channel closed once more arrive
+func (s *MemoryStore) pendingEvents(gameId string, afterSeq int64) ([][]byte, int64, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	eventLog := s.eventLog(gameId)
+	firstSeq := eventLog.seq - int64(len(eventLog.events)) + 1
+	start := max(afterSeq+1, firstSeq)
+	if start > eventLog.seq {
+		return nil, max(afterSeq, eventLog.seq), eventLog.notify
+	}
+	events := append([][]byte(nil), eventLog.events[start-firstSeq:]...)
+	return events, eventLog.seq, eventLog.notify
+}
+
+func (s *MemoryStore) SubscribeToGame(ctx context.Context, gameId string, afterSeq int64) (Subscription, error) {
+	sub := &memorySubscription{
+		ch:   make(chan []byte),
+		done: make(chan struct{}),
+	}
+	go sub.read(s, gameId, afterSeq)
+	return sub, nil
+}
+
+func (s *MemoryStore) GameEventsSince(ctx context.Context, gameId string, afterSeq int64) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	eventLog := s.events[gameId]
+	if eventLog == nil {
+		return nil, nil
+	}
+	events, err := eventsAfter(eventLog.events, eventLog.seq, afterSeq)
+	return append([][]byte(nil), events...), err
+}
+
+func (s *MemoryStore) LastGameEventSeq(ctx context.Context, gameId string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if eventLog := s.events[gameId]; eventLog != nil {
+		return eventLog.seq, nil
+	}
+	return 0, nil
+}
+
+// memorySubscription follows a game's log the way a stream reader would
+type memorySubscription struct {
+	ch        chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// read delivers events of gameId after afterSeq until the subscription is closed
+func (sub *memorySubscription) read(s *MemoryStore, gameId string, afterSeq int64) {
+	defer close(sub.ch)
+
+	for {
+		events, lastSeq, notify := s.pendingEvents(gameId, afterSeq)
+		for _, event := range events {
+			select {
+			case sub.ch <- event:
+			case <-sub.done:
+				return
+			}
+		}
+		afterSeq = lastSeq
+
+		select {
+		case <-notify:
+		case <-sub.done:
+			return
+		}
+	}
+}
+
+func (sub *memorySubscription) Channel() <-chan []byte {
+	return sub.ch
+}
+
+func (sub *memorySubscription) Close() error {
+	sub.closeOnce.Do(func() { close(sub.done) })
+	return nil
+}
+
+// clone returns a copy of cache that shares no slices or maps with the original
+func (cache RedisCache) clone() RedisCache {
+	cache.Users = append([]User(nil), cache.Users...)
+	cache.LastDrawOfferPly = maps.Clone(cache.LastDrawOfferPly)
+	cache.DisconnectedAtMs = maps.Clone(cache.DisconnectedAtMs)
+	cache.ClockHistory = append([]ClockSnapshot(nil), cache.ClockHistory...)
+	if cache.Result != nil {
+		result := *cache.Result
+		cache.Result = &result
+	}
+	return cache
+}
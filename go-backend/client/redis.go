@@ -4,11 +4,15 @@ package client
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"log"
 	"os"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/yashgadle/go-chess/common"
 )
 
 var (
@@ -30,6 +34,79 @@ type RedisCache struct {
 	WhiteTimeMs  int64  `json:"whiteTimeMs"`
 	BlackTimeMs  int64  `json:"blackTimeMs"`
 	LastMoveAtMs int64  `json:"lastMoveAtMs"`
+	// StartedAtMs is when both players had joined; 0 until then
+	StartedAtMs int64 `json:"startedAtMs,omitempty"`
+	// Result records how the game ended, once GameEnd is set
+	Result *common.GameResult `json:"result,omitempty"`
+	// TimeControl drives how the clocks are updated after each move
+	TimeControl common.TimeControl `json:"timeControl"`
+	// SpectatorDelay holds spectators back from the live game
+	SpectatorDelay common.SpectatorDelay `json:"spectatorDelay"`
+	// DrawOffer is the pending draw offer, if any
+	DrawOffer DrawOffer `json:"drawOffer"`
+	// LastDrawOfferPly is the ply of each color's most recent draw offer
+	LastDrawOfferPly map[string]int `json:"lastDrawOfferPly,omitempty"`
+	// Takeback is the pending takeback request, if any
+	Takeback TakebackRequest `json:"takeback"`
+	// ClockHistory holds both clocks as they were before each ply
+	ClockHistory []ClockSnapshot `json:"clockHistory,omitempty"`
+	// RematchOffer is the color that offered a rematch, if any
+	RematchOffer string `json:"rematchOffer,omitempty"`
+	// RematchOf is the game this one is a rematch of
+	RematchOf string `json:"rematchOf,omitempty"`
+	// RematchId is the game that was created as this one's rematch
+	RematchId string `json:"rematchId,omitempty"`
+	// DisconnectedAtMs is when each absent color's last connection dropped
+	DisconnectedAtMs map[string]int64 `json:"disconnectedAtMs,omitempty"`
+	// VictoryClaimableBy is the color that was told it may claim victory over
+	// its absent opponent
+	VictoryClaimableBy string `json:"victoryClaimableBy,omitempty"`
+	// Rated games count towards ratings
+	Rated bool `json:"rated,omitempty"`
+	// Version is bumped on every update and guards compare-and-set writes
+	Version int64 `json:"version"`
+}
+
+// LobbySeek is a seek as stored, along with who posted it. UserId is a
+// session id and never leaves the server.
+type LobbySeek struct {
+	UserId string      `json:"userId"`
+	Seek   common.Seek `json:"seek"`
+	// SeenAtMs is when the seek was last refreshed by its poster's instance
+	SeenAtMs int64 `json:"seenAtMs"`
+}
+
+// QueueEntry is a user waiting in a matchmaking queue
+type QueueEntry struct {
+	UserId string `json:"userId"`
+	// TimeControl is the canonical spec of the queue
+	TimeControl string `json:"time"`
+	Rating      int    `json:"rating"`
+	JoinedAtMs  int64  `json:"joinedAtMs"`
+	// SeenAtMs is when the entry was last refreshed by its user's instance
+	SeenAtMs int64 `json:"seenAtMs"`
+}
+
+// DrawOffer records who offered a draw and at which ply.
+// By is empty when no offer is pending.
+type DrawOffer struct {
+	By  string `json:"by,omitempty"`
+	Ply int    `json:"ply,omitempty"`
+}
+
+// TakebackRequest records who asked to take back moves and at which ply.
+// By is empty when no request is pending.
+type TakebackRequest struct {
+	By  string `json:"by,omitempty"`
+	Ply int    `json:"ply,omitempty"`
+}
+
+// ClockSnapshot is the state of both clocks at a point in the game
+type ClockSnapshot struct {
+	WhiteTimeMs int64 `json:"whiteTimeMs"`
+	BlackTimeMs int64 `json:"blackTimeMs"`
+	// LastMoveAtMs is when the clock of the side to move started running
+	LastMoveAtMs int64 `json:"lastMoveAtMs,omitempty"`
 }
 
 // UpdateOptions allows updating specific fields in RedisCache
@@ -40,9 +117,40 @@ type UpdateOptions struct {
 	Board        *string
 	PGN          *string
 	GameEnd      *bool
+	Result       *common.GameResult
 	WhiteTimeMs  *int64
 	BlackTimeMs  *int64
 	LastMoveAtMs *int64
+	StartedAtMs  *int64
+	Rated        *bool
+	// DrawOffer replaces the pending offer; pass &DrawOffer{} to clear it
+	DrawOffer        *DrawOffer
+	LastDrawOfferPly *map[string]int
+	// Takeback replaces the pending request; pass &TakebackRequest{} to clear it
+	Takeback     *TakebackRequest
+	ClockHistory *[]ClockSnapshot
+	RematchOffer *string
+	RematchId    *string
+	// DisconnectedAtMs replaces the whole map
+	DisconnectedAtMs   *map[string]int64
+	VictoryClaimableBy *string
+	// Version, when set, is the version the caller read. The update is rejected
+	// with a *ConflictError if the stored game has moved on since.
+	Version *int64
+}
+
+// updateRetries bounds how often an update is retried when another writer
+// touches the game between our read and our write
+const updateRetries = 5
+
+// ConflictError is returned when a conditional update lost a race with another writer
+type ConflictError struct {
+	GameId  string
+	Version int64 // version currently stored, 0 if unknown
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("game %s was modified concurrently (version %d)", e.GameId, e.Version)
 }
 
 func Redis() (*redis.Client, error) {
@@ -62,8 +170,21 @@ func Redis() (*redis.Client, error) {
 	return rdb, initErr
 }
 
+// RedisStore is the GameStore and EventBus backed by Redis.
+// Game state lives under the game id and events go through pub/sub channels.
+type RedisStore struct{}
+
+func NewRedisStore() *RedisStore {
+	return &RedisStore{}
+}
+
+func (s *RedisStore) Ping(ctx context.Context) error {
+	_, err := Redis()
+	return err
+}
+
 // setVal is a private function used internally to write RedisCache to Redis
-func setVal(ctx context.Context, key string, val RedisCache, exp *time.Duration) error {
+func (s *RedisStore) setVal(ctx context.Context, key string, val RedisCache, exp *time.Duration) error {
 	client, err := Redis()
 	if err != nil {
 		return err
@@ -84,13 +205,16 @@ func setVal(ctx context.Context, key string, val RedisCache, exp *time.Duration)
 	return cmd.Err()
 }
 
-func GetVal(ctx context.Context, key string) (*RedisCache, error) {
+func (s *RedisStore) GetVal(ctx context.Context, key string) (*RedisCache, error) {
 	client, err := Redis()
 	if err != nil {
 		return nil, err
 	}
 
 	data, err := client.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -102,67 +226,622 @@ func GetVal(ctx context.Context, key string) (*RedisCache, error) {
 	return &gameCache, nil
 }
 
-// CreateGame creates a new game in Redis with the specified values.
-// exp can be nil for no expiration, or set to specify expiration.
-func CreateGame(ctx context.Context, key string, cache RedisCache, exp *time.Duration) error {
-	return setVal(ctx, key, cache, exp)
+func (s *RedisStore) CreateGame(ctx context.Context, key string, cache RedisCache, exp *time.Duration) error {
+	return s.setVal(ctx, key, cache, exp)
+}
+
+func (s *RedisStore) DeleteGame(ctx context.Context, gameId string) error {
+	client, err := Redis()
+	if err != nil {
+		return err
+	}
+	return client.Del(ctx, gameId).Err()
+}
+
+// UpdateVal merges updates inside a WATCH/MULTI transaction so concurrent
+// writers never overwrite each other. Transactions aborted by a concurrent
+// write are retried; a stale updates.Version is reported as a *ConflictError.
+func (s *RedisStore) UpdateVal(ctx context.Context, gameId string, updates UpdateOptions, exp *time.Duration) error {
+	client, err := Redis()
+	if err != nil {
+		return err
+	}
+
+	txf := func(tx *redis.Tx) error {
+		// Get current value - must exist
+		data, err := tx.Get(ctx, gameId).Result()
+		if err == redis.Nil {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		var current RedisCache
+		if err := json.Unmarshal([]byte(data), &current); err != nil {
+			return err
+		}
+		if updates.Version != nil && *updates.Version != current.Version {
+			return &ConflictError{GameId: gameId, Version: current.Version}
+		}
+
+		// Merge updates into current value
+		updates.merge(&current)
+		current.Version++
+
+		val, err := json.Marshal(current)
+		if err != nil {
+			return err
+		}
+
+		// Write back the merged value, only if nobody else wrote in between
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if exp == nil {
+				pipe.SetArgs(ctx, gameId, val, redis.SetArgs{KeepTTL: true})
+			} else {
+				pipe.Set(ctx, gameId, val, *exp)
+			}
+			return nil
+		})
+		return err
+	}
+
+	for i := 0; i < updateRetries; i++ {
+		err = client.Watch(ctx, txf, gameId)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return &ConflictError{GameId: gameId}
+}
+
+// presenceTTL keeps presence counts from outliving the game they belong to
+const presenceTTL = 24 * time.Hour
+
+// AddPresence keeps per-color connection counts in a hash next to the game
+func (s *RedisStore) AddPresence(ctx context.Context, gameId string, color string, delta int64) (int64, error) {
+	client, err := Redis()
+	if err != nil {
+		return 0, err
+	}
+	key := "presence:" + gameId
+	var count *redis.IntCmd
+	_, err = client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		count = pipe.HIncrBy(ctx, key, color, delta)
+		pipe.Expire(ctx, key, presenceTTL)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count.Val(), nil
+}
+
+func (s *RedisStore) GetPresence(ctx context.Context, gameId string) (map[string]int64, error) {
+	client, err := Redis()
+	if err != nil {
+		return nil, err
+	}
+	counts, err := client.HGetAll(ctx, "presence:"+gameId).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	presence := make(map[string]int64, len(counts))
+	for color, count := range counts {
+		n, err := strconv.ParseInt(count, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		presence[color] = n
+	}
+	return presence, nil
+}
+
+// chatTTL keeps chat logs and mutes from outliving the game they belong to
+const chatTTL = 24 * time.Hour
+
+// AppendChat pushes msg onto a capped list per room
+func (s *RedisStore) AppendChat(ctx context.Context, gameId string, room string, msg []byte) error {
+	client, err := Redis()
+	if err != nil {
+		return err
+	}
+	key := "chat:" + gameId + ":" + room
+	_, err = client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.RPush(ctx, key, msg)
+		pipe.LTrim(ctx, key, -chatLogSize, -1)
+		pipe.Expire(ctx, key, chatTTL)
+		return nil
+	})
+	return err
+}
+
+func (s *RedisStore) ChatLog(ctx context.Context, gameId string, room string) ([][]byte, error) {
+	client, err := Redis()
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := client.LRange(ctx, "chat:"+gameId+":"+room, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	chatLog := make([][]byte, len(msgs))
+	for i, msg := range msgs {
+		chatLog[i] = []byte(msg)
+	}
+	return chatLog, nil
+}
+
+// SetChatMuted keeps the users who muted a game's chat in a set
+func (s *RedisStore) SetChatMuted(ctx context.Context, gameId string, userId string, muted bool) error {
+	client, err := Redis()
+	if err != nil {
+		return err
+	}
+	key := "chatmuted:" + gameId
+	_, err = client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if muted {
+			pipe.SAdd(ctx, key, userId)
+		} else {
+			pipe.SRem(ctx, key, userId)
+		}
+		pipe.Expire(ctx, key, chatTTL)
+		return nil
+	})
+	return err
+}
+
+func (s *RedisStore) ChatMuted(ctx context.Context, gameId string, userId string) (bool, error) {
+	client, err := Redis()
+	if err != nil {
+		return false, err
+	}
+	return client.SIsMember(ctx, "chatmuted:"+gameId, userId).Result()
+}
+
+// CountChat keeps the count in a key that expires with its window, so
+// quiet users leave nothing behind
+func (s *RedisStore) CountChat(ctx context.Context, gameId string, userId string, window time.Duration) (int64, error) {
+	client, err := Redis()
+	if err != nil {
+		return 0, err
+	}
+	key := "chatrate:" + gameId + ":" + userId
+	var count *redis.IntCmd
+	_, err = client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		// Only the first message of a window starts its clock
+		pipe.SetNX(ctx, key, 0, window)
+		count = pipe.Incr(ctx, key)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count.Val(), nil
+}
+
+// seeksKey is the hash holding every open seek by id
+const seeksKey = "lobby:seeks"
+
+func (s *RedisStore) AddSeek(ctx context.Context, seek LobbySeek) error {
+	client, err := Redis()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(seek)
+	if err != nil {
+		return err
+	}
+	return client.HSet(ctx, seeksKey, seek.Seek.Id, data).Err()
+}
+
+// refreshSeeksScript marks the listed seeks as seen, and drops and returns
+// every other seek last seen before the cutoff
+//
+//	KEYS[1] seeks, ARGV[1] now, ARGV[2] cutoff, ARGV[3...] seek ids
+var refreshSeeksScript = redis.NewScript(`
+local refresh = {}
+for i = 3, #ARGV do
+	refresh[ARGV[i]] = true
+end
+local expired = {}
+local fields = redis.call('HGETALL', KEYS[1])
+for i = 1, #fields, 2 do
+	local seek = cjson.decode(fields[i + 1])
+	if refresh[fields[i]] then
+		seek.seenAtMs = tonumber(ARGV[1])
+		redis.call('HSET', KEYS[1], fields[i], cjson.encode(seek))
+	elseif (seek.seenAtMs or 0) < tonumber(ARGV[2]) then
+		redis.call('HDEL', KEYS[1], fields[i])
+		table.insert(expired, fields[i + 1])
+	end
+end
+return expired
+`)
+
+func (s *RedisStore) RefreshSeeks(ctx context.Context, ids []string, nowMs int64, ttl time.Duration) ([]LobbySeek, error) {
+	client, err := Redis()
+	if err != nil {
+		return nil, err
+	}
+	args := []interface{}{nowMs, nowMs - ttl.Milliseconds()}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	fields, err := refreshSeeksScript.Run(ctx, client, []string{seeksKey}, args...).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+
+	expired := make([]LobbySeek, 0, len(fields))
+	for _, data := range fields {
+		var seek LobbySeek
+		if err := json.Unmarshal([]byte(data), &seek); err != nil {
+			return nil, err
+		}
+		expired = append(expired, seek)
+	}
+	return expired, nil
 }
 
-// UpdateVal updates only the specified fields in Redis without affecting other fields.
-// Pass an UpdateOptions struct with pointers to the fields you want to update.
-// Nil pointers mean "don't update this field".
-// Returns an error if the key doesn't exist - use CreateGame to create new games.
-// exp can be nil to keep existing TTL.
-func UpdateVal(ctx context.Context, gameId string, updates UpdateOptions, exp *time.Duration) error {
-	// Get current value - must exist
-	current, err := GetVal(ctx, gameId)
+// TakeSeek reads and deletes the seek in one transaction; whoever's delete
+// removed the field owns the seek
+func (s *RedisStore) TakeSeek(ctx context.Context, id string) (*LobbySeek, error) {
+	client, err := Redis()
+	if err != nil {
+		return nil, err
+	}
+	var get *redis.StringCmd
+	var del *redis.IntCmd
+	_, err = client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		get = pipe.HGet(ctx, seeksKey, id)
+		del = pipe.HDel(ctx, seeksKey, id)
+		return nil
+	})
+	if err == redis.Nil || (err == nil && del.Val() == 0) {
+		return nil, ErrSeekNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var seek LobbySeek
+	if err := json.Unmarshal([]byte(get.Val()), &seek); err != nil {
+		return nil, err
+	}
+	return &seek, nil
+}
+
+func (s *RedisStore) ListSeeks(ctx context.Context) ([]LobbySeek, error) {
+	client, err := Redis()
+	if err != nil {
+		return nil, err
+	}
+	fields, err := client.HGetAll(ctx, seeksKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	seeks := make([]LobbySeek, 0, len(fields))
+	for _, data := range fields {
+		var seek LobbySeek
+		if err := json.Unmarshal([]byte(data), &seek); err != nil {
+			return nil, err
+		}
+		seeks = append(seeks, seek)
+	}
+	sortSeeks(seeks)
+	return seeks, nil
+}
+
+// queueKey is the hash of users waiting in any matchmaking queue, by user id
+const queueKey = "lobby:queue"
+
+func (s *RedisStore) JoinQueue(ctx context.Context, entry QueueEntry) error {
+	client, err := Redis()
 	if err != nil {
 		return err
 	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return client.HSet(ctx, queueKey, entry.UserId, data).Err()
+}
 
-	// Merge updates into current value
-	if updates.Users != nil {
-		current.Users = *updates.Users
+// leaveQueueScript removes a user from the queue, if they wait for the given
+// time control or it is empty
+//
+//	KEYS[1] queue, ARGV[1] user id, ARGV[2] time control
+var leaveQueueScript = redis.NewScript(`
+local data = redis.call('HGET', KEYS[1], ARGV[1])
+if not data then
+	return 0
+end
+if ARGV[2] ~= '' and cjson.decode(data).time ~= ARGV[2] then
+	return 0
+end
+redis.call('HDEL', KEYS[1], ARGV[1])
+return 1
+`)
+
+func (s *RedisStore) LeaveQueue(ctx context.Context, timeControl string, userId string) (bool, error) {
+	client, err := Redis()
+	if err != nil {
+		return false, err
 	}
-	if updates.Board != nil {
-		current.Board = *updates.Board
+	removed, err := leaveQueueScript.Run(ctx, client, []string{queueKey}, userId, timeControl).Int()
+	return removed == 1, err
+}
+
+// refreshQueueScript marks the listed users waiting for a time control as
+// seen, and drops every other entry last seen before the cutoff
+//
+//	KEYS[1] queue, ARGV[1] time control, ARGV[2] now, ARGV[3] cutoff,
+//	ARGV[4...] user ids
+var refreshQueueScript = redis.NewScript(`
+local refresh = {}
+for i = 4, #ARGV do
+	refresh[ARGV[i]] = true
+end
+local fields = redis.call('HGETALL', KEYS[1])
+for i = 1, #fields, 2 do
+	local entry = cjson.decode(fields[i + 1])
+	if refresh[fields[i]] and entry.time == ARGV[1] then
+		entry.seenAtMs = tonumber(ARGV[2])
+		redis.call('HSET', KEYS[1], fields[i], cjson.encode(entry))
+	elseif (entry.seenAtMs or 0) < tonumber(ARGV[3]) then
+		redis.call('HDEL', KEYS[1], fields[i])
+	end
+end
+return 0
+`)
+
+func (s *RedisStore) RefreshQueue(ctx context.Context, timeControl string, userIds []string, nowMs int64, ttl time.Duration) error {
+	client, err := Redis()
+	if err != nil {
+		return err
 	}
-	if updates.PGN != nil {
-		current.PGN = *updates.PGN
+	args := []interface{}{timeControl, nowMs, nowMs - ttl.Milliseconds()}
+	for _, userId := range userIds {
+		args = append(args, userId)
 	}
-	if updates.GameEnd != nil {
-		current.GameEnd = *updates.GameEnd
+	return refreshQueueScript.Run(ctx, client, []string{queueKey}, args...).Err()
+}
+
+// takePairScript removes two users from the queue only if both still wait
+// for the given time control
+//
+//	KEYS[1] queue, ARGV[1] and ARGV[2] user ids, ARGV[3] time control
+var takePairScript = redis.NewScript(`
+local a = redis.call('HGET', KEYS[1], ARGV[1])
+local b = redis.call('HGET', KEYS[1], ARGV[2])
+if a and b and cjson.decode(a).time == ARGV[3] and cjson.decode(b).time == ARGV[3] then
+	redis.call('HDEL', KEYS[1], ARGV[1], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+func (s *RedisStore) TakeQueuedPair(ctx context.Context, timeControl string, userA string, userB string) (bool, error) {
+	client, err := Redis()
+	if err != nil {
+		return false, err
 	}
-	if updates.WhiteTimeMs != nil {
-		current.WhiteTimeMs = *updates.WhiteTimeMs
+	taken, err := takePairScript.Run(ctx, client, []string{queueKey}, userA, userB, timeControl).Int()
+	return taken == 1, err
+}
+
+func (s *RedisStore) ListQueue(ctx context.Context, timeControl string) ([]QueueEntry, error) {
+	client, err := Redis()
+	if err != nil {
+		return nil, err
 	}
-	if updates.BlackTimeMs != nil {
-		current.BlackTimeMs = *updates.BlackTimeMs
+	fields, err := client.HGetAll(ctx, queueKey).Result()
+	if err != nil {
+		return nil, err
 	}
-	if updates.LastMoveAtMs != nil {
-		current.LastMoveAtMs = *updates.LastMoveAtMs
+
+	entries := make([]QueueEntry, 0, len(fields))
+	for _, data := range fields {
+		var entry QueueEntry
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			return nil, err
+		}
+		if entry.TimeControl == timeControl {
+			entries = append(entries, entry)
+		}
 	}
+	sortQueue(entries)
+	return entries, nil
+}
+
+// publishScript numbers an event and appends it to the game's stream in one
+// step. The sequence number doubles as the entry ID ("<seq>-0"), so readers
+// can start from any event number.
+//
+//	KEYS[1] sequence counter, KEYS[2] stream
+//	ARGV[1] event, ARGV[2] stream length, ARGV[3] ttl seconds, 0 for none
+var publishScript = redis.NewScript(`
+local seq = redis.call('INCR', KEYS[1])
+local event = '{"seq":' .. seq .. ',' .. string.sub(ARGV[1], 2)
+redis.call('XADD', KEYS[2], 'MAXLEN', ARGV[2], seq .. '-0', 'event', event)
+if ARGV[3] == '0' then
+	redis.call('PERSIST', KEYS[1])
+	redis.call('PERSIST', KEYS[2])
+else
+	redis.call('EXPIRE', KEYS[1], ARGV[3])
+	redis.call('EXPIRE', KEYS[2], ARGV[3])
+end
+return seq
+`)
+
+// eventLogTTL keeps the event stream from outliving the game it belongs to
+const eventLogTTL = 24 * time.Hour
 
-	// Write back the merged value
-	return setVal(ctx, gameId, *current, exp)
+// eventLogTTLOf is how long the log of gameId lasts after its last event.
+// The lobby feed outlives every game and is followed from its last event
+// number for as long as an instance runs, so its counter must never start
+// over; it doesn't expire.
+func eventLogTTLOf(gameId string) time.Duration {
+	if gameId == common.LobbyFeed {
+		return 0
+	}
+	return eventLogTTL
 }
 
-// PubSub functions for cross-instance communication
-func PublishGameEvent(ctx context.Context, gameId string, event []byte) error {
+// streamBlock bounds each blocking stream read so closed subscriptions are noticed
+const streamBlock = 2 * time.Second
+
+// streamRetryDelay is how long a subscription waits before reading again after an error
+const streamRetryDelay = time.Second
+
+// PublishGameEvent appends event to the game's stream. Unlike pub/sub nothing
+// is lost if no instance happens to be listening at that moment.
+func (s *RedisStore) PublishGameEvent(ctx context.Context, gameId string, event []byte) error {
 	client, err := Redis()
 	if err != nil {
 		return err
 	}
-	channel := "game:" + gameId
-	return client.Publish(ctx, channel, event).Err()
+	keys := []string{"events:seq:" + gameId, "events:" + gameId}
+	return publishScript.Run(ctx, client, keys, event, eventLogSize, int(eventLogTTLOf(gameId).Seconds())).Err()
 }
 
-func SubscribeToGame(ctx context.Context, gameId string) (*redis.PubSub, error) {
+// SubscribeToGame reads the game's stream from just after afterSeq
+func (s *RedisStore) SubscribeToGame(ctx context.Context, gameId string, afterSeq int64) (Subscription, error) {
 	client, err := Redis()
 	if err != nil {
 		return nil, err
 	}
-	channel := "game:" + gameId
-	pubsub := client.Subscribe(ctx, channel)
-	return pubsub, nil
+	return newRedisSubscription(client, "events:"+gameId, afterSeq), nil
+}
+
+func (s *RedisStore) GameEventsSince(ctx context.Context, gameId string, afterSeq int64) ([][]byte, error) {
+	client, err := Redis()
+	if err != nil {
+		return nil, err
+	}
+
+	// Read the counter and the stream together so they agree with each other
+	var seqCmd *redis.StringCmd
+	var streamCmd *redis.XMessageSliceCmd
+	_, err = client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		seqCmd = pipe.Get(ctx, "events:seq:"+gameId)
+		streamCmd = pipe.XRange(ctx, "events:"+gameId, "-", "+")
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	lastSeq, err := seqCmd.Int64()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var events [][]byte
+	for _, msg := range streamCmd.Val() {
+		if event, ok := msg.Values["event"].(string); ok {
+			events = append(events, []byte(event))
+		}
+	}
+	return eventsAfter(events, lastSeq, afterSeq)
+}
+
+func (s *RedisStore) LastGameEventSeq(ctx context.Context, gameId string) (int64, error) {
+	client, err := Redis()
+	if err != nil {
+		return 0, err
+	}
+	seq, err := client.Get(ctx, "events:seq:"+gameId).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return seq, err
+}
+
+// redisSubscription follows a game's stream with blocking reads. It keeps
+// its own position, so a dropped Redis connection only delays delivery.
+type redisSubscription struct {
+	client    *redis.Client
+	stream    string
+	ch        chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newRedisSubscription(client *redis.Client, stream string, afterSeq int64) *redisSubscription {
+	sub := &redisSubscription{
+		client: client,
+		stream: stream,
+		ch:     make(chan []byte),
+		done:   make(chan struct{}),
+	}
+	go sub.read(fmt.Sprintf("%d-0", afterSeq))
+	return sub
+}
+
+// read delivers stream entries after lastId until the subscription is closed
+func (sub *redisSubscription) read(lastId string) {
+	defer close(sub.ch)
+
+	ctx, cancel := context.WithCancel(Ctx)
+	defer cancel()
+	go func() {
+		<-sub.done
+		cancel()
+	}()
+
+	for {
+		streams, err := sub.client.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{sub.stream, lastId},
+			Count:   eventLogSize,
+			Block:   streamBlock,
+		}).Result()
+
+		select {
+		case <-sub.done:
+			return
+		default:
+		}
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			log.Printf("Reading %s failed, retrying from %s: %v", sub.stream, lastId, err)
+			select {
+			case <-time.After(streamRetryDelay):
+				continue
+			case <-sub.done:
+				return
+			}
+		}
+
+		for _, stream := range streams {
+			for _, msg := range stream.Messages {
+				lastId = msg.ID
+				event, ok := msg.Values["event"].(string)
+				if !ok {
+					continue
+				}
+				select {
+				case sub.ch <- []byte(event):
+				case <-sub.done:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (sub *redisSubscription) Channel() <-chan []byte {
+	return sub.ch
+}
+
+func (sub *redisSubscription) Close() error {
+	sub.closeOnce.Do(func() { close(sub.done) })
+	return nil
 }
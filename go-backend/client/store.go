@@ -0,0 +1,382 @@
+package client
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned when a game does not exist or has expired
+var ErrNotFound = errors.New("game not found")
+
+// ErrSeekNotFound is returned when a seek was cancelled or already taken
+var ErrSeekNotFound = errors.New("seek not found")
+
+// GameStore persists game state keyed by game id
+type GameStore interface {
+	// Ping reports whether the backend is reachable
+	Ping(ctx context.Context) error
+	GetVal(ctx context.Context, gameId string) (*RedisCache, error)
+	CreateGame(ctx context.Context, gameId string, cache RedisCache, exp *time.Duration) error
+	// DeleteGame removes a game, if it exists
+	DeleteGame(ctx context.Context, gameId string) error
+	UpdateVal(ctx context.Context, gameId string, updates UpdateOptions, exp *time.Duration) error
+	// AddPresence adjusts the number of open connections for color in a game
+	// and returns the new count
+	AddPresence(ctx context.Context, gameId string, color string, delta int64) (int64, error)
+	// GetPresence returns the number of open connections per color across all instances
+	GetPresence(ctx context.Context, gameId string) (map[string]int64, error)
+	// AppendChat adds msg to the log of a chat room, keeping the latest chatLogSize
+	AppendChat(ctx context.Context, gameId string, room string, msg []byte) error
+	// ChatLog returns the kept messages of a chat room, oldest first
+	ChatLog(ctx context.Context, gameId string, room string) ([][]byte, error)
+	// SetChatMuted records whether userId has muted the chat of a game
+	SetChatMuted(ctx context.Context, gameId string, userId string, muted bool) error
+	ChatMuted(ctx context.Context, gameId string, userId string) (bool, error)
+	// CountChat counts a chat message from userId in a game and returns how
+	// many they have sent in the current window, which lasts window from
+	// their first message in it
+	CountChat(ctx context.Context, gameId string, userId string, window time.Duration) (int64, error)
+	// AddSeek posts a seek to the lobby
+	AddSeek(ctx context.Context, seek LobbySeek) error
+	// TakeSeek removes the seek with id and returns it. Of callers racing for
+	// the same seek only one gets it; the others get ErrSeekNotFound.
+	TakeSeek(ctx context.Context, id string) (*LobbySeek, error)
+	// ListSeeks returns the open seeks, oldest first
+	ListSeeks(ctx context.Context) ([]LobbySeek, error)
+	// RefreshSeeks marks the seeks with ids as seen at nowMs, and drops and
+	// returns every other seek not seen within ttl of it
+	RefreshSeeks(ctx context.Context, ids []string, nowMs int64, ttl time.Duration) ([]LobbySeek, error)
+	// JoinQueue puts entry in the matchmaking queue for entry.TimeControl.
+	// A user waits in one queue at a time, so this replaces any earlier entry.
+	JoinQueue(ctx context.Context, entry QueueEntry) error
+	// LeaveQueue takes userId out of the queue for timeControl, or out of
+	// whichever queue they are in when timeControl is empty, and reports
+	// whether they were in it
+	LeaveQueue(ctx context.Context, timeControl string, userId string) (bool, error)
+	// RefreshQueue marks the entries of userIds still waiting for timeControl
+	// as seen at nowMs, and drops every entry, of any queue, not seen within
+	// ttl of it
+	RefreshQueue(ctx context.Context, timeControl string, userIds []string, nowMs int64, ttl time.Duration) error
+	// TakeQueuedPair takes two users out of a queue together, if both are
+	// still waiting in it, and reports whether it did
+	TakeQueuedPair(ctx context.Context, timeControl string, userA string, userB string) (bool, error)
+	// ListQueue returns who is waiting in a queue, longest waiting first
+	ListQueue(ctx context.Context, timeControl string) ([]QueueEntry, error)
+}
+
+// chatLogSize is how many messages each chat room keeps
+const chatLogSize = 100
+
+// ErrEventsExpired is returned when events asked for have already dropped out of the replay log
+var ErrEventsExpired = errors.New("events are no longer available")
+
+// eventLogSize is how many recent events each game's log keeps
+const eventLogSize = 256
+
+// Subscription is a live feed of events published for a single game
+type Subscription interface {
+	// Channel delivers raw event payloads. It is closed once the subscription ends.
+	Channel() <-chan []byte
+	Close() error
+}
+
+// EventBus keeps an append-only, numbered log of each game's events that
+// every instance interested in the game follows
+type EventBus interface {
+	// PublishGameEvent stamps event, a non-empty JSON object, with the game's
+	// next sequence number as "seq" and appends it to the game's log
+	PublishGameEvent(ctx context.Context, gameId string, event []byte) error
+	// SubscribeToGame delivers every event numbered above afterSeq, first
+	// those already in the log and then new ones as they are published.
+	// Events that dropped out of the log before being read are skipped.
+	SubscribeToGame(ctx context.Context, gameId string, afterSeq int64) (Subscription, error)
+	// GameEventsSince returns the logged events numbered above afterSeq, oldest first.
+	// ErrEventsExpired means some of them are no longer kept.
+	GameEventsSince(ctx context.Context, gameId string, afterSeq int64) ([][]byte, error)
+	// LastGameEventSeq returns the sequence number of the latest event, 0 if there is none
+	LastGameEventSeq(ctx context.Context, gameId string) (int64, error)
+}
+
+var (
+	store     GameStore
+	bus       EventBus
+	storeOnce sync.Once
+)
+
+// backend returns the configured store and bus.
+// GAME_STORE selects the implementation: "redis" (default) or "memory".
+func backend() (GameStore, EventBus) {
+	storeOnce.Do(func() {
+		switch os.Getenv("GAME_STORE") {
+		case "memory":
+			m := NewMemoryStore()
+			store, bus = m, m
+		default:
+			r := NewRedisStore()
+			store, bus = r, r
+		}
+	})
+	return store, bus
+}
+
+// SetBackend replaces the configured store and bus.
+// Call it before serving any request, e.g. from tests or a single-node setup.
+func SetBackend(s GameStore, b EventBus) {
+	storeOnce.Do(func() {})
+	store, bus = s, b
+}
+
+func Ping(ctx context.Context) error {
+	s, _ := backend()
+	return s.Ping(ctx)
+}
+
+func GetVal(ctx context.Context, gameId string) (*RedisCache, error) {
+	s, _ := backend()
+	return s.GetVal(ctx, gameId)
+}
+
+// CreateGame creates a new game with the specified values.
+// exp can be nil for no expiration, or set to specify expiration.
+func CreateGame(ctx context.Context, gameId string, cache RedisCache, exp *time.Duration) error {
+	s, _ := backend()
+	return s.CreateGame(ctx, gameId, cache, exp)
+}
+
+// DeleteGame removes a game that should never have been created, e.g. one
+// whose creation lost a race. Deleting a game that doesn't exist is no error.
+func DeleteGame(ctx context.Context, gameId string) error {
+	s, _ := backend()
+	return s.DeleteGame(ctx, gameId)
+}
+
+// UpdateVal updates only the specified fields without affecting other fields.
+// Pass an UpdateOptions struct with pointers to the fields you want to update.
+// Nil pointers mean "don't update this field".
+// Returns an error if the key doesn't exist - use CreateGame to create new games.
+// Set updates.Version to the version you read to get compare-and-set semantics;
+// a *ConflictError means the game changed underneath you and should be re-read.
+// exp can be nil to keep existing TTL.
+func UpdateVal(ctx context.Context, gameId string, updates UpdateOptions, exp *time.Duration) error {
+	s, _ := backend()
+	return s.UpdateVal(ctx, gameId, updates, exp)
+}
+
+// AddPresence records a connection for color in gameId opening (delta 1) or closing (delta -1)
+// and returns how many connections color now has
+func AddPresence(ctx context.Context, gameId string, color string, delta int64) (int64, error) {
+	s, _ := backend()
+	return s.AddPresence(ctx, gameId, color, delta)
+}
+
+func GetPresence(ctx context.Context, gameId string) (map[string]int64, error) {
+	s, _ := backend()
+	return s.GetPresence(ctx, gameId)
+}
+
+// AppendChat stores msg, a relayed chat message, in room of gameId
+func AppendChat(ctx context.Context, gameId string, room string, msg []byte) error {
+	s, _ := backend()
+	return s.AppendChat(ctx, gameId, room, msg)
+}
+
+func ChatLog(ctx context.Context, gameId string, room string) ([][]byte, error) {
+	s, _ := backend()
+	return s.ChatLog(ctx, gameId, room)
+}
+
+func SetChatMuted(ctx context.Context, gameId string, userId string, muted bool) error {
+	s, _ := backend()
+	return s.SetChatMuted(ctx, gameId, userId, muted)
+}
+
+func ChatMuted(ctx context.Context, gameId string, userId string) (bool, error) {
+	s, _ := backend()
+	return s.ChatMuted(ctx, gameId, userId)
+}
+
+func CountChat(ctx context.Context, gameId string, userId string, window time.Duration) (int64, error) {
+	s, _ := backend()
+	return s.CountChat(ctx, gameId, userId, window)
+}
+
+func AddSeek(ctx context.Context, seek LobbySeek) error {
+	s, _ := backend()
+	return s.AddSeek(ctx, seek)
+}
+
+// TakeSeek claims the seek with id, e.g. to accept or cancel it
+func TakeSeek(ctx context.Context, id string) (*LobbySeek, error) {
+	s, _ := backend()
+	return s.TakeSeek(ctx, id)
+}
+
+func ListSeeks(ctx context.Context) ([]LobbySeek, error) {
+	s, _ := backend()
+	return s.ListSeeks(ctx)
+}
+
+// RefreshSeeks keeps the seeks of users still connected from expiring.
+// Seeks whose instance has gone stop being refreshed and are dropped.
+func RefreshSeeks(ctx context.Context, ids []string, nowMs int64, ttl time.Duration) ([]LobbySeek, error) {
+	s, _ := backend()
+	return s.RefreshSeeks(ctx, ids, nowMs, ttl)
+}
+
+func JoinQueue(ctx context.Context, entry QueueEntry) error {
+	s, _ := backend()
+	return s.JoinQueue(ctx, entry)
+}
+
+func LeaveQueue(ctx context.Context, timeControl string, userId string) (bool, error) {
+	s, _ := backend()
+	return s.LeaveQueue(ctx, timeControl, userId)
+}
+
+// RefreshQueue keeps the entries of users still connected from expiring.
+// Entries whose instance has gone stop being refreshed and are dropped.
+func RefreshQueue(ctx context.Context, timeControl string, userIds []string, nowMs int64, ttl time.Duration) error {
+	s, _ := backend()
+	return s.RefreshQueue(ctx, timeControl, userIds, nowMs, ttl)
+}
+
+// TakeQueuedPair claims two waiting users for a game. Instances matching
+// the same queue at once can't both pair the same user.
+func TakeQueuedPair(ctx context.Context, timeControl string, userA string, userB string) (bool, error) {
+	s, _ := backend()
+	return s.TakeQueuedPair(ctx, timeControl, userA, userB)
+}
+
+func ListQueue(ctx context.Context, timeControl string) ([]QueueEntry, error) {
+	s, _ := backend()
+	return s.ListQueue(ctx, timeControl)
+}
+
+// sortQueue orders entries longest waiting first
+func sortQueue(entries []QueueEntry) {
+	slices.SortFunc(entries, func(a, b QueueEntry) int {
+		return cmp.Or(cmp.Compare(a.JoinedAtMs, b.JoinedAtMs), cmp.Compare(a.UserId, b.UserId))
+	})
+}
+
+// sortSeeks orders seeks oldest first
+func sortSeeks(seeks []LobbySeek) {
+	slices.SortFunc(seeks, func(a, b LobbySeek) int {
+		return cmp.Or(cmp.Compare(a.Seek.CreatedAtMs, b.Seek.CreatedAtMs), cmp.Compare(a.Seek.Id, b.Seek.Id))
+	})
+}
+
+// PublishGameEvent sends an event to every instance subscribed to the game
+func PublishGameEvent(ctx context.Context, gameId string, event []byte) error {
+	_, b := backend()
+	return b.PublishGameEvent(ctx, gameId, event)
+}
+
+func SubscribeToGame(ctx context.Context, gameId string, afterSeq int64) (Subscription, error) {
+	_, b := backend()
+	return b.SubscribeToGame(ctx, gameId, afterSeq)
+}
+
+func GameEventsSince(ctx context.Context, gameId string, afterSeq int64) ([][]byte, error) {
+	_, b := backend()
+	return b.GameEventsSince(ctx, gameId, afterSeq)
+}
+
+func LastGameEventSeq(ctx context.Context, gameId string) (int64, error) {
+	_, b := backend()
+	return b.LastGameEventSeq(ctx, gameId)
+}
+
+// eventsAfter picks the events numbered above afterSeq out of a replay log
+// that runs up to lastSeq
+func eventsAfter(log [][]byte, lastSeq int64, afterSeq int64) ([][]byte, error) {
+	if afterSeq >= lastSeq {
+		return nil, nil
+	}
+	firstSeq := lastSeq + 1
+	if len(log) > 0 {
+		seq, err := eventSeq(log[0])
+		if err != nil {
+			return nil, err
+		}
+		firstSeq = seq
+	}
+	if afterSeq+1 < firstSeq {
+		return nil, ErrEventsExpired
+	}
+	return log[len(log)-int(lastSeq-afterSeq):], nil
+}
+
+// eventSeq reads the sequence number stamped on a published event
+func eventSeq(event []byte) (int64, error) {
+	var stamped struct {
+		Seq int64 `json:"seq"`
+	}
+	err := json.Unmarshal(event, &stamped)
+	return stamped.Seq, err
+}
+
+// merge applies the non-nil fields of updates onto cache
+func (updates UpdateOptions) merge(cache *RedisCache) {
+	if updates.Users != nil {
+		cache.Users = *updates.Users
+	}
+	if updates.Board != nil {
+		cache.Board = *updates.Board
+	}
+	if updates.PGN != nil {
+		cache.PGN = *updates.PGN
+	}
+	if updates.GameEnd != nil {
+		cache.GameEnd = *updates.GameEnd
+	}
+	if updates.Result != nil {
+		result := *updates.Result
+		cache.Result = &result
+	}
+	if updates.WhiteTimeMs != nil {
+		cache.WhiteTimeMs = *updates.WhiteTimeMs
+	}
+	if updates.BlackTimeMs != nil {
+		cache.BlackTimeMs = *updates.BlackTimeMs
+	}
+	if updates.LastMoveAtMs != nil {
+		cache.LastMoveAtMs = *updates.LastMoveAtMs
+	}
+	if updates.StartedAtMs != nil {
+		cache.StartedAtMs = *updates.StartedAtMs
+	}
+	if updates.Rated != nil {
+		cache.Rated = *updates.Rated
+	}
+	if updates.DrawOffer != nil {
+		cache.DrawOffer = *updates.DrawOffer
+	}
+	if updates.LastDrawOfferPly != nil {
+		cache.LastDrawOfferPly = *updates.LastDrawOfferPly
+	}
+	if updates.Takeback != nil {
+		cache.Takeback = *updates.Takeback
+	}
+	if updates.ClockHistory != nil {
+		cache.ClockHistory = *updates.ClockHistory
+	}
+	if updates.RematchOffer != nil {
+		cache.RematchOffer = *updates.RematchOffer
+	}
+	if updates.RematchId != nil {
+		cache.RematchId = *updates.RematchId
+	}
+	if updates.DisconnectedAtMs != nil {
+		cache.DisconnectedAtMs = *updates.DisconnectedAtMs
+	}
+	if updates.VictoryClaimableBy != nil {
+		cache.VictoryClaimableBy = *updates.VictoryClaimableBy
+	}
+}
@@ -8,26 +8,222 @@ import (
 type MessageType string
 
 const (
-	MsgSignal           MessageType = "signal"
-	MsgStartGame        MessageType = "start_game"
-	MsgStartClock       MessageType = "start_clock"
-	MsgMove             MessageType = "move"
-	MsgTimeSync         MessageType = "time_sync"
-	MsgResign           MessageType = "resign"
-	MsgDrawOffer        MessageType = "draw"
-	MsgDrawAccept       MessageType = "draw_accept"
-	MsgExplicitGameOver MessageType = "explicit_game_over"
+	MsgSignal          MessageType = "signal"
+	MsgStartGame       MessageType = "start_game"
+	MsgStartClock      MessageType = "start_clock"
+	MsgMove            MessageType = "move"
+	MsgTimeSync        MessageType = "time_sync"
+	MsgResign          MessageType = "resign"
+	MsgDrawOffer       MessageType = "draw"
+	MsgDrawAccept      MessageType = "draw_accept"
+	MsgDrawDecline     MessageType = "draw_decline"
+	MsgClaimDraw       MessageType = "claim_draw"
+	MsgAbort           MessageType = "abort"
+	MsgRematchOffer    MessageType = "rematch_offer"
+	MsgRematchAccept   MessageType = "rematch_accept"
+	MsgRematch         MessageType = "rematch"
+	MsgTakebackRequest MessageType = "takeback_request"
+	MsgTakebackAccept  MessageType = "takeback_accept"
+	MsgTakebackDecline MessageType = "takeback_decline"
+	MsgGameOver        MessageType = "game_over"
+	MsgGameState       MessageType = "game_state"
+	MsgSyncRequest     MessageType = "sync_request"
+	MsgAck             MessageType = "ack"
+	MsgSkip            MessageType = "skip"
+	MsgResumeFrom      MessageType = "resume_from"
+	MsgError           MessageType = "error"
+
+	// Presence changes, reported to the opponent of the player named in the payload
+	MsgOpponentDisconnected MessageType = "opponent_disconnected"
+	MsgOpponentReconnected  MessageType = "opponent_reconnected"
+
+	// Once an opponent has been away for the grace period, the player left
+	// behind may end the game as a win or a draw
+	MsgCanClaimVictory  MessageType = "can_claim_victory"
+	MsgClaimVictory     MessageType = "claim_victory"
+	MsgClaimDrawAbandon MessageType = "claim_draw_abandon"
+
+	// Chat, kept in separate rooms for players and spectators
+	MsgChat        MessageType = "chat"
+	MsgChatHistory MessageType = "chat_history"
+	MsgChatMute    MessageType = "chat_mute"
+
+	// Lobby seeks, sent over /ws/lobby
+	MsgSeek        MessageType = "seek"
+	MsgSeekCancel  MessageType = "seek_cancel"
+	MsgSeekAccept  MessageType = "seek_accept"
+	MsgSeekRemoved MessageType = "seek_removed"
+	MsgSeeks       MessageType = "seeks"
+	MsgGameFound   MessageType = "game_found"
+
+	// Quick pairing, also over /ws/lobby. The server echoes each to confirm it.
+	MsgQueueJoin  MessageType = "queue_join"
+	MsgQueueLeave MessageType = "queue_leave"
+)
+
+// ErrorCode tells the client why an action was rejected
+type ErrorCode string
+
+const (
+	ErrBadMessage      ErrorCode = "bad_message"
+	ErrUnknownType     ErrorCode = "unknown_type"
+	ErrIllegalMove     ErrorCode = "illegal_move"
+	ErrInvalidDraw     ErrorCode = "invalid_draw"
+	ErrRateLimited     ErrorCode = "rate_limited"
+	ErrInvalidTakeback ErrorCode = "invalid_takeback"
+	ErrInvalidAbort    ErrorCode = "invalid_abort"
+	ErrInvalidRematch  ErrorCode = "invalid_rematch"
+	ErrInvalidClaim    ErrorCode = "invalid_claim"
+	ErrInvalidChat     ErrorCode = "invalid_chat"
+	ErrInvalidSeek     ErrorCode = "invalid_seek"
+	ErrInvalidQueue    ErrorCode = "invalid_queue"
+	ErrNotPlayer       ErrorCode = "not_player"
+	ErrNotYourTurn     ErrorCode = "not_your_turn"
+	ErrGameOver        ErrorCode = "game_over"
+	ErrInvalidPGN      ErrorCode = "invalid_pgn"
+	ErrGameNotFound    ErrorCode = "game_not_found"
+	ErrInternal        ErrorCode = "internal"
 )
 
+// ErrorPayload is sent to a single player whose action was rejected
+type ErrorPayload struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	// RequestId echoes the requestId of the offending message, if it had one
+	RequestId string `json:"requestId,omitempty"`
+}
+
 type GOType string
 
 const (
 	Resignation     GOType = "resignation"
 	DrawByAgreement GOType = "draw_by_agreement"
+	Timeout         GOType = "timeout"
+	Checkmate       GOType = "checkmate"
+	Stalemate       GOType = "stalemate"
+	// Draws a player may claim
+	ThreefoldRepetition GOType = "threefold_repetition"
+	FiftyMoveRule       GOType = "fifty_move_rule"
+	// Draws applied automatically
+	FivefoldRepetition   GOType = "fivefold_repetition"
+	SeventyFiveMoveRule  GOType = "seventy_five_move_rule"
+	InsufficientMaterial GOType = "insufficient_material"
+	// Aborted games were called off before both players moved
+	Aborted GOType = "aborted"
+	// Abandonment is claimed by the player left behind when the opponent stays away
+	Abandonment GOType = "abandonment"
 )
 
-type ExplicitGameOverPayload struct {
-	GameOverType GOType `json:"gameOverType"`
+// GameResult is how a game ended. It is stored with the game and sent to
+// both players in a game_over event, whatever ended the game.
+type GameResult struct {
+	// Winner is empty when the game was drawn
+	Winner PlayerColor `json:"winner,omitempty"`
+	Method GOType      `json:"method"`
+	// FEN and PGN are the final position and game record, including the result
+	FEN         string `json:"fen"`
+	PGN         string `json:"pgn"`
+	WhiteTimeMs int64  `json:"whiteTimeMs"`
+	BlackTimeMs int64  `json:"blackTimeMs"`
+	// EndedAtMs is when the game ended
+	EndedAtMs int64 `json:"endedAtMs,omitempty"`
+}
+
+// Counts reports whether the game should count towards ratings and history.
+// Aborted games don't.
+func (r GameResult) Counts() bool {
+	return r.Method != Aborted
+}
+
+// ClaimDrawPayload names the draw being claimed. An empty Reason claims
+// whichever draw the position allows.
+type ClaimDrawPayload struct {
+	Reason GOType `json:"reason,omitempty"`
+}
+
+// DrawOfferPayload announces a draw offer from By
+type DrawOfferPayload struct {
+	By PlayerColor `json:"by"`
+}
+
+// DrawDeclinePayload announces that the pending draw offer is gone.
+// Expired is set when the offer lapsed because the opponent moved instead.
+type DrawDeclinePayload struct {
+	Expired bool `json:"expired,omitempty"`
+}
+
+// ChatRoom separates the players' chat from the spectators'
+type ChatRoom string
+
+const (
+	PlayersRoom    ChatRoom = "players"
+	SpectatorsRoom ChatRoom = "spectators"
+)
+
+// ChatPayload is a chat message. Clients send only Text; the server fills in
+// the rest when relaying it. Color is empty for spectators.
+type ChatPayload struct {
+	Room     ChatRoom    `json:"room,omitempty"`
+	Color    PlayerColor `json:"color,omitempty"`
+	Text     string      `json:"text"`
+	SentAtMs int64       `json:"sentAtMs,omitempty"`
+}
+
+// ChatHistoryPayload holds the kept messages of a room, oldest first
+type ChatHistoryPayload struct {
+	Room     ChatRoom      `json:"room"`
+	Messages []ChatPayload `json:"messages"`
+}
+
+// ChatMutePayload turns chat from everyone else on or off for the sender
+type ChatMutePayload struct {
+	Muted bool `json:"muted"`
+}
+
+// AckPayload is sent by a client to confirm it has handled every event up to Seq.
+// The server sends an ack with no payload, carrying the event's Seq, to the
+// player whose action produced the event, in place of echoing it back.
+type AckPayload struct {
+	Seq int64 `json:"seq"`
+}
+
+// ResumeFromPayload asks for every event after Seq to be sent again.
+// Without a payload the server resumes from the client's last ack.
+type ResumeFromPayload struct {
+	Seq int64 `json:"seq"`
+}
+
+// RematchOfferPayload announces that By wants a rematch
+type RematchOfferPayload struct {
+	By PlayerColor `json:"by"`
+}
+
+// RematchPayload tells a player where the agreed rematch is played.
+// Urls holds the join URL for each color; each player receives only their
+// own as GameUrl, along with the color they play.
+type RematchPayload struct {
+	GameId      string                 `json:"gameId"`
+	RematchOf   string                 `json:"rematchOf"`
+	GameUrl     string                 `json:"gameUrl,omitempty"`
+	PlayerColor PlayerColor            `json:"playerColor,omitempty"`
+	Urls        map[PlayerColor]string `json:"urls,omitempty"`
+}
+
+// PresencePayload names the player whose last connection dropped, or who came back
+type PresencePayload struct {
+	Color PlayerColor `json:"color"`
+}
+
+// CanClaimVictoryPayload tells By that their opponent has been away past the
+// grace period, so By may send claim_victory or claim_draw_abandon
+type CanClaimVictoryPayload struct {
+	By PlayerColor `json:"by"`
+}
+
+// TakebackPayload announces a takeback request from By that would undo Plies half moves
+type TakebackPayload struct {
+	By    PlayerColor `json:"by"`
+	Plies int         `json:"plies"`
 }
 
 type SignalPayload struct {
@@ -36,15 +232,20 @@ type SignalPayload struct {
 }
 
 type MovePayload struct {
-	FromSquare  string `json:"fromSquare"`
-	ToSquare    string `json:"toSquare"`
+	FromSquare string `json:"fromSquare"`
+	ToSquare   string `json:"toSquare"`
+	// Promotion is the piece a pawn promotes to: "q", "r", "b" or "n".
+	// Omitting it on a promotion promotes to a queen.
+	Promotion   string `json:"promotion,omitempty"`
 	WhiteTimeMs int64  `json:"whiteTimeMs,omitempty"`
 	BlackTimeMs int64  `json:"blackTimeMs,omitempty"`
 }
 
+// StartGamePayload announces that both players are in. PlayerColor is the
+// recipient's color, and left out for spectators.
 type StartGamePayload struct {
 	PGN         string      `json:"pgn"`
-	PlayerColor PlayerColor `json:"playerColor"`
+	PlayerColor PlayerColor `json:"playerColor,omitempty"`
 }
 
 type StartClockPayload struct {
@@ -53,9 +254,60 @@ type StartClockPayload struct {
 	LastMoveAtMs int64 `json:"lastMoveAtMs,omitempty"`
 }
 
+// GameStatePayload is the authoritative snapshot of a game.
+// It is sent on every (re)connect, on request, and whenever a client's view
+// may be stale and needs to be replaced.
+type GameStatePayload struct {
+	PGN string `json:"pgn"`
+	FEN string `json:"fen"`
+	// WhiteTimeMs and BlackTimeMs are the clocks as they read at ServerTimeMs
+	WhiteTimeMs  int64       `json:"whiteTimeMs"`
+	BlackTimeMs  int64       `json:"blackTimeMs"`
+	LastMoveAtMs int64       `json:"lastMoveAtMs,omitempty"`
+	ServerTimeMs int64       `json:"serverTimeMs"`
+	SideToMove   PlayerColor `json:"sideToMove"`
+	GameEnd      bool        `json:"gameEnd"`
+	// Result is set once the game is over
+	Result *GameResult `json:"result,omitempty"`
+	// DrawOffer and RematchOffer are the colors with a pending offer, if any
+	DrawOffer    PlayerColor      `json:"drawOffer,omitempty"`
+	Takeback     *TakebackPayload `json:"takeback,omitempty"`
+	RematchOffer PlayerColor      `json:"rematchOffer,omitempty"`
+	RematchId    string           `json:"rematchId,omitempty"`
+	// VictoryClaimableBy is the color that may claim victory over an absent opponent
+	VictoryClaimableBy PlayerColor `json:"victoryClaimableBy,omitempty"`
+	// Seq is the last event reflected in the snapshot; resume from here
+	Seq int64 `json:"seq,omitempty"`
+	// PlayerColor is the recipient's color, empty for someone not playing
+	PlayerColor PlayerColor `json:"playerColor,omitempty"`
+	// OpponentConnected is left out of snapshots broadcast to both players
+	OpponentConnected *bool `json:"opponentConnected,omitempty"`
+	// SpectatorDelay is how far behind the live game a spectator's view is
+	SpectatorDelay *SpectatorDelay `json:"spectatorDelay,omitempty"`
+}
+
+// ForSpectators returns the snapshot without what only the players may see:
+// offers and requests between them, and the recipient's own details
+func (gs GameStatePayload) ForSpectators() GameStatePayload {
+	gs.DrawOffer = ""
+	gs.Takeback = nil
+	gs.RematchOffer = ""
+	gs.RematchId = ""
+	gs.VictoryClaimableBy = ""
+	gs.PlayerColor = ""
+	gs.OpponentConnected = nil
+	return gs
+}
+
 type WSMessage struct {
 	Type MessageType     `json:"type"`
 	Data json.RawMessage `json:"data,omitempty"`
+	// RequestId is optionally set by clients to match errors to their messages
+	RequestId string `json:"requestId,omitempty"`
+	// Seq numbers game events, per game and without gaps. Events a player
+	// doesn't get, like muted chat, arrive as a skip carrying only their Seq.
+	// Messages meant for a single player, like errors and snapshots, have none.
+	Seq int64 `json:"seq,omitempty"`
 }
 
 // PubSubEvent represents an event published to Redis pub/sub
@@ -64,4 +316,6 @@ type PubSubEvent struct {
 	Data       json.RawMessage `json:"data,omitempty"`
 	GameId     string          `json:"gameId"`
 	FromUserId string          `json:"fromUserId,omitempty"` // to avoid echo back to sender
+	// Seq is stamped by the event bus when the event is published
+	Seq int64 `json:"seq,omitempty"`
 }
@@ -7,7 +7,10 @@ type Game struct {
 	White *Player
 	Black *Player
 	PGN   string
-	mu    sync.Mutex // lock needed
+	// spectators watching the game on this instance
+	spectators     map[*Spectator]struct{}
+	spectatorDelay SpectatorDelay
+	mu             sync.Mutex // lock needed
 }
 
 func (g *Game) AddPlayer(p *Player) {
@@ -22,3 +25,84 @@ func (g *Game) AddPlayer(p *Player) {
 		g.Black = p
 	}
 }
+
+// RemovePlayer takes p out of the game if it still holds p's seat, and
+// reports whether the game has nobody left, players or spectators
+func (g *Game) RemovePlayer(p *Player) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.White == p {
+		g.White = nil
+	}
+	if g.Black == p {
+		g.Black = nil
+	}
+	return g.empty()
+}
+
+func (g *Game) AddSpectator(s *Spectator) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.spectators == nil {
+		g.spectators = make(map[*Spectator]struct{})
+	}
+	g.spectators[s] = struct{}{}
+}
+
+// RemoveSpectator takes s out of the game, and reports whether the game has
+// nobody left, players or spectators
+func (g *Game) RemoveSpectator(s *Spectator) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.spectators, s)
+	return g.empty()
+}
+
+// empty reports whether nobody is in the game. Callers must hold g.mu.
+func (g *Game) empty() bool {
+	return g.White == nil && g.Black == nil && len(g.spectators) == 0
+}
+
+// Players returns the players currently seated in the game
+func (g *Game) Players() []*Player {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var players []*Player
+	if g.White != nil {
+		players = append(players, g.White)
+	}
+	if g.Black != nil {
+		players = append(players, g.Black)
+	}
+	return players
+}
+
+// Spectators returns the spectators currently watching the game
+func (g *Game) Spectators() []*Spectator {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	spectators := make([]*Spectator, 0, len(g.spectators))
+	for s := range g.spectators {
+		spectators = append(spectators, s)
+	}
+	return spectators
+}
+
+// SetSpectatorDelay records how far spectators are held back, as read from
+// the stored game
+func (g *Game) SetSpectatorDelay(d SpectatorDelay) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.spectatorDelay = d
+}
+
+func (g *Game) SpectatorDelay() SpectatorDelay {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.spectatorDelay
+}
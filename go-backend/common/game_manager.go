@@ -30,8 +30,45 @@ func (gm *GameManager) GetOrCreateGame(gameId string, pgn string) *Game {
 	return game
 }
 
+// GameCount returns how many games have local state on this instance
+func (gm *GameManager) GameCount() int {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+	return len(gm.Games)
+}
+
 func (gm *GameManager) GetGame(gameId string) *Game {
 	gm.mu.Lock()
 	defer gm.mu.Unlock()
 	return gm.Games[gameId]
 }
+
+// Leave removes p from gameId, and drops the game once nobody is left in it.
+// A player who has since been replaced by a newer connection leaves nothing behind.
+func (gm *GameManager) Leave(gameId string, p *Player) {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+
+	game := gm.Games[gameId]
+	if game == nil {
+		return
+	}
+	if game.RemovePlayer(p) {
+		delete(gm.Games, gameId)
+	}
+}
+
+// Unwatch removes spectator s from gameId, and drops the game once nobody is
+// left in it
+func (gm *GameManager) Unwatch(gameId string, s *Spectator) {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+
+	game := gm.Games[gameId]
+	if game == nil {
+		return
+	}
+	if game.RemoveSpectator(s) {
+		delete(gm.Games, gameId)
+	}
+}
@@ -0,0 +1,66 @@
+package common
+
+import (
+	"github.com/gorilla/websocket"
+)
+
+// LobbyFeed is the event log lobby events are published to. It sits next
+// to the games' logs, so every instance follows it the same way.
+const LobbyFeed = "lobby"
+
+// Seek is an open invitation in the lobby to play a game. Clients post the
+// time control, color and rating fields; the server fills in the rest.
+type Seek struct {
+	Id string `json:"id"`
+	// TimeControl is a spec ParseTimeControl accepts, e.g. "5|2"
+	TimeControl string `json:"time"`
+	// Color the seeker wants to play; empty means either, picked at random
+	Color PlayerColor `json:"color,omitempty"`
+	Rated bool        `json:"rated"`
+	// RatingMin and RatingMax bound the opponent's rating; 0 leaves a side open
+	RatingMin int `json:"ratingMin,omitempty"`
+	RatingMax int `json:"ratingMax,omitempty"`
+	// Rating is the seeker's rating when the seek was posted
+	Rating      int   `json:"rating"`
+	CreatedAtMs int64 `json:"createdAtMs"`
+	// Mine is set on the seeks the recipient posted
+	Mine bool `json:"mine,omitempty"`
+}
+
+// SeeksPayload lists every open seek, oldest first
+type SeeksPayload struct {
+	Seeks []Seek `json:"seeks"`
+}
+
+// SeekIdPayload names a seek to cancel or accept, or one that is gone
+type SeekIdPayload struct {
+	Id string `json:"id"`
+}
+
+// QueuePayload names the time control of a matchmaking queue, e.g. "5|2".
+// Confirmations carry it in canonical form, e.g. "5+2".
+type QueuePayload struct {
+	TimeControl string `json:"time"`
+}
+
+// GameFoundPayload sends both users of an accepted seek or a quick pairing
+// to their new game.
+// Colors maps each user to their color and Urls each color to its join URL;
+// each user receives only their own color and URL.
+type GameFoundPayload struct {
+	GameId      string                 `json:"gameId"`
+	GameUrl     string                 `json:"gameUrl,omitempty"`
+	PlayerColor PlayerColor            `json:"playerColor,omitempty"`
+	Colors      map[string]PlayerColor `json:"colors,omitempty"`
+	Urls        map[PlayerColor]string `json:"urls,omitempty"`
+}
+
+// LobbyMember is a user connected to the lobby
+type LobbyMember struct {
+	Id string
+	*Socket
+}
+
+func NewLobbyMember(id string, conn *websocket.Conn) *LobbyMember {
+	return &LobbyMember{Id: id, Socket: NewSocket(conn)}
+}
@@ -1,6 +1,10 @@
 package common
 
-import "github.com/gorilla/websocket"
+import (
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
 
 type PlayerColor string
 
@@ -12,6 +16,20 @@ const (
 type Player struct {
 	Id    string
 	Color PlayerColor
-	Conn  *websocket.Conn
-	Send  chan []byte
+	*Socket
+	// AckedSeq is the last game event the client confirmed handling
+	AckedSeq atomic.Int64
+}
+
+func NewPlayer(id string, color PlayerColor, conn *websocket.Conn) *Player {
+	return &Player{
+		Id:     id,
+		Color:  color,
+		Socket: NewSocket(conn),
+	}
+}
+
+// Seated reports whether p plays White or Black in their game
+func (p *Player) Seated() bool {
+	return p.Color == White || p.Color == Black
 }
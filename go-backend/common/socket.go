@@ -0,0 +1,73 @@
+package common
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// socketSendBuffer is how many outgoing messages may queue for a socket
+const socketSendBuffer = 16
+
+// Socket is a websocket connection with its outgoing queue, shared by
+// players and spectators
+type Socket struct {
+	Conn *websocket.Conn
+	// Send queues messages for the socket's writer. It is never closed, since
+	// several goroutines write to it; use Enqueue and watch Done instead.
+	Send chan []byte
+	// ChatMuted stops chat from anyone else reaching the socket
+	ChatMuted atomic.Bool
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewSocket(conn *websocket.Conn) *Socket {
+	return &Socket{
+		Conn: conn,
+		Send: make(chan []byte, socketSendBuffer),
+		done: make(chan struct{}),
+	}
+}
+
+// Done is closed once the connection is finished with
+func (s *Socket) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close stops the socket's writer and closes the connection. It is safe to
+// call more than once and from any goroutine.
+func (s *Socket) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.Conn.Close()
+	})
+}
+
+// Enqueue waits for room to queue msg. It reports false if the socket was
+// closed first.
+func (s *Socket) Enqueue(msg []byte) bool {
+	select {
+	case s.Send <- msg:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// TryEnqueue queues msg only if there is room right away
+func (s *Socket) TryEnqueue(msg []byte) bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+	select {
+	case s.Send <- msg:
+		return true
+	default:
+		return false
+	}
+}
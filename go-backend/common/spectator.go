@@ -0,0 +1,54 @@
+package common
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Spectator watches a game without taking part in it. Spectators are kept
+// apart from players, so nothing they send can reach the game.
+type Spectator struct {
+	// Id is the spectator's guest session, used for their chat
+	Id string
+	*Socket
+}
+
+func NewSpectator(id string, conn *websocket.Conn) *Spectator {
+	return &Spectator{Id: id, Socket: NewSocket(conn)}
+}
+
+// Longest spectator delays a game may be created with
+const (
+	maxSpectatorDelay      = 15 * time.Minute
+	maxSpectatorDelayPlies = 40
+)
+
+// SpectatorDelay holds spectators back from the live game, either by time
+// or by a number of plies. The zero value shows spectators the game live.
+type SpectatorDelay struct {
+	Ms    int64 `json:"ms,omitempty"`
+	Plies int   `json:"plies,omitempty"`
+}
+
+// NewSpectatorDelay validates a delay of seconds or of plies; at most one
+// of them may be set
+func NewSpectatorDelay(seconds int, plies int) (SpectatorDelay, error) {
+	switch {
+	case seconds < 0 || plies < 0:
+		return SpectatorDelay{}, fmt.Errorf("spectator delay cannot be negative")
+	case seconds > 0 && plies > 0:
+		return SpectatorDelay{}, fmt.Errorf("spectator delay is either in seconds or in plies, not both")
+	case time.Duration(seconds)*time.Second > maxSpectatorDelay:
+		return SpectatorDelay{}, fmt.Errorf("spectator delay is at most %s", maxSpectatorDelay)
+	case plies > maxSpectatorDelayPlies:
+		return SpectatorDelay{}, fmt.Errorf("spectator delay is at most %d plies", maxSpectatorDelayPlies)
+	}
+	return SpectatorDelay{Ms: int64(seconds) * 1000, Plies: plies}, nil
+}
+
+// Enabled reports whether spectators are held back at all
+func (d SpectatorDelay) Enabled() bool {
+	return d.Ms > 0 || d.Plies > 0
+}
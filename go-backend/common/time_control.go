@@ -0,0 +1,243 @@
+package common
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Time controls offered when creating a game, as "minutes|increment seconds"
+const (
+	Time10_5 = "10|5"
+	Time5_2  = "5|2"
+	Time3_1  = "3|1"
+	Time1_0  = "1|0"
+)
+
+// Limits on a stage's times, so a spec can't start a game that never
+// flags or overflow the clocks
+const (
+	minBaseMs  = 1000
+	maxBaseMs  = 6 * 60 * 60 * 1000
+	maxBonusMs = 5 * 60 * 1000
+)
+
+// ClockMode decides what a stage's bonus does after each move
+type ClockMode string
+
+const (
+	// Increment (Fischer) adds the bonus to the mover's clock after every move
+	Increment ClockMode = "increment"
+	// Bronstein adds back the time spent on the move, up to the bonus
+	Bronstein ClockMode = "bronstein"
+	// SimpleDelay (US delay) waits for the bonus before the clock starts running
+	SimpleDelay ClockMode = "delay"
+)
+
+// TimeStage is one period of a time control. All durations are in milliseconds.
+type TimeStage struct {
+	// Moves each player must make in this stage; 0 means the rest of the game
+	Moves   int       `json:"moves,omitempty"`
+	BaseMs  int64     `json:"baseMs"`
+	Mode    ClockMode `json:"mode"`
+	BonusMs int64     `json:"bonusMs,omitempty"`
+}
+
+// TimeControl is a parsed time control made of one or more stages.
+// Time left over from one stage carries into the next.
+type TimeControl struct {
+	Spec   string      `json:"spec"`
+	Stages []TimeStage `json:"stages"`
+}
+
+// DefaultTimeControl is used when a game is created without a time control
+var DefaultTimeControl = TimeControl{
+	Spec:   "5+0",
+	Stages: []TimeStage{{BaseMs: 5 * 60 * 1000, Mode: Increment}},
+}
+
+// ParseTimeControl parses a time control spec. Stages are separated by ":".
+// Each stage is an optional "moves/" prefix, base minutes, and an optional
+// bonus in seconds:
+//
+//	15|10, 90+30      base plus Fischer increment
+//	2d3               simple (US) delay
+//	5b2               Bronstein delay
+//	40/90+30:30+30    90 minutes for 40 moves, then 30 more for the rest
+//
+// A final stage with a move count repeats for as long as the game lasts.
+func ParseTimeControl(spec string) (TimeControl, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return TimeControl{}, fmt.Errorf("time control is empty")
+	}
+
+	tc := TimeControl{Spec: spec}
+	for _, part := range strings.Split(spec, ":") {
+		stage, err := parseStage(strings.TrimSpace(part))
+		if err != nil {
+			return TimeControl{}, fmt.Errorf("invalid time control %q: %w", spec, err)
+		}
+		tc.Stages = append(tc.Stages, stage)
+	}
+
+	for _, stage := range tc.Stages[:len(tc.Stages)-1] {
+		if stage.Moves == 0 {
+			return TimeControl{}, fmt.Errorf("invalid time control %q: only the last stage may run for the rest of the game", spec)
+		}
+	}
+	return tc, nil
+}
+
+func parseStage(stage string) (TimeStage, error) {
+	var ts TimeStage
+
+	if moves, rest, ok := strings.Cut(stage, "/"); ok {
+		n, err := strconv.Atoi(moves)
+		if err != nil || n <= 0 {
+			return ts, fmt.Errorf("move count %q must be a positive integer", moves)
+		}
+		ts.Moves = n
+		stage = rest
+	}
+
+	base, bonus := stage, ""
+	ts.Mode = Increment
+	if i := strings.IndexAny(stage, "+|db"); i >= 0 {
+		base, bonus = stage[:i], stage[i+1:]
+		switch stage[i] {
+		case 'd':
+			ts.Mode = SimpleDelay
+		case 'b':
+			ts.Mode = Bronstein
+		}
+		if bonus == "" {
+			return ts, fmt.Errorf("missing seconds after %q", stage[i])
+		}
+	}
+
+	minutes, err := parseAmount(base)
+	if err != nil {
+		return ts, fmt.Errorf("base time %w", err)
+	}
+	baseMs := math.Round(minutes * 60 * 1000)
+	if baseMs < minBaseMs || baseMs > maxBaseMs {
+		return ts, fmt.Errorf("base time must be between 1 second and %d hours", maxBaseMs/(60*60*1000))
+	}
+	ts.BaseMs = int64(baseMs)
+
+	if bonus != "" {
+		seconds, err := parseAmount(bonus)
+		if err != nil {
+			return ts, fmt.Errorf("bonus %w", err)
+		}
+		bonusMs := math.Round(seconds * 1000)
+		if bonusMs > maxBonusMs {
+			return ts, fmt.Errorf("bonus must be at most %d minutes", maxBonusMs/(60*1000))
+		}
+		ts.BonusMs = int64(bonusMs)
+	}
+	return ts, nil
+}
+
+func parseAmount(s string) (float64, error) {
+	v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || v < 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("%q is not a non-negative number", s)
+	}
+	return v, nil
+}
+
+// Canonical returns the spec of tc in one form, so that specs meaning the
+// same time control, like "5|2" and "5+2", compare equal
+func (tc TimeControl) Canonical() string {
+	parts := make([]string, len(tc.Stages))
+	for i, stage := range tc.Stages {
+		var b strings.Builder
+		if stage.Moves > 0 {
+			fmt.Fprintf(&b, "%d/", stage.Moves)
+		}
+		b.WriteString(strconv.FormatFloat(float64(stage.BaseMs)/(60*1000), 'f', -1, 64))
+		switch stage.Mode {
+		case SimpleDelay:
+			b.WriteByte('d')
+		case Bronstein:
+			b.WriteByte('b')
+		default:
+			b.WriteByte('+')
+		}
+		b.WriteString(strconv.FormatFloat(float64(stage.BonusMs)/1000, 'f', -1, 64))
+		parts[i] = b.String()
+	}
+	return strings.Join(parts, ":")
+}
+
+// InitialMs is the time each player starts with
+func (tc TimeControl) InitialMs() int64 {
+	if len(tc.Stages) == 0 {
+		return DefaultTimeControl.InitialMs()
+	}
+	return tc.Stages[0].BaseMs
+}
+
+// stage returns the stage a player's moveNumber-th move falls in,
+// and whether that move is the last one of its stage.
+func (tc TimeControl) stage(moveNumber int) (TimeStage, bool) {
+	stages := tc.Stages
+	if len(stages) == 0 {
+		stages = DefaultTimeControl.Stages
+	}
+
+	for i, stage := range stages {
+		if stage.Moves == 0 {
+			return stage, false
+		}
+		if i == len(stages)-1 {
+			// A final stage with a move count repeats
+			moveNumber = (moveNumber-1)%stage.Moves + 1
+		}
+		if moveNumber <= stage.Moves {
+			return stage, moveNumber == stage.Moves
+		}
+		moveNumber -= stage.Moves
+	}
+	return stages[len(stages)-1], false
+}
+
+// nextStage returns the stage that follows the one containing moveNumber
+func (tc TimeControl) nextStage(moveNumber int) TimeStage {
+	next, _ := tc.stage(moveNumber + 1)
+	return next
+}
+
+// AfterMove returns the mover's clock once their moveNumber-th move, which
+// took elapsedMs, is made. The stage's bonus is applied according to its mode
+// and finishing a stage adds the next stage's base time.
+func (tc TimeControl) AfterMove(remainingMs int64, elapsedMs int64, moveNumber int) int64 {
+	stage, lastOfStage := tc.stage(moveNumber)
+
+	switch stage.Mode {
+	case Bronstein:
+		remainingMs += -elapsedMs + min(elapsedMs, stage.BonusMs)
+	case SimpleDelay:
+		remainingMs -= max(elapsedMs-stage.BonusMs, 0)
+	default:
+		remainingMs += -elapsedMs + stage.BonusMs
+	}
+
+	if lastOfStage {
+		remainingMs += tc.nextStage(moveNumber).BaseMs
+	}
+	return remainingMs
+}
+
+// AllowanceMs returns how long the side to move may think on its
+// moveNumber-th move before flagging
+func (tc TimeControl) AllowanceMs(remainingMs int64, moveNumber int) int64 {
+	stage, _ := tc.stage(moveNumber)
+	if stage.Mode == SimpleDelay {
+		return remainingMs + stage.BonusMs
+	}
+	return remainingMs
+}
@@ -0,0 +1,68 @@
+package common
+
+import "testing"
+
+func TestParseTimeControlLimits(t *testing.T) {
+	tests := []struct {
+		spec    string
+		wantErr bool
+	}{
+		{spec: "5|2"},
+		{spec: "40/90+30:30+30"},
+		{spec: "360+300"},
+		{spec: "0.01|0", wantErr: true},
+		{spec: "0|5", wantErr: true},
+		{spec: "361|0", wantErr: true},
+		{spec: "5|301", wantErr: true},
+		{spec: "1e15|0", wantErr: true},
+		{spec: "5|1e15", wantErr: true},
+		{spec: "NaN|0", wantErr: true},
+		{spec: "5|NaN", wantErr: true},
+		{spec: "Inf|0", wantErr: true},
+		{spec: "5|+Inf", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			_, err := ParseTimeControl(tt.spec)
+			if tt.wantErr && err == nil {
+				t.Errorf("ParseTimeControl(%q) succeeded, want an error", tt.spec)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("ParseTimeControl(%q): %v", tt.spec, err)
+			}
+		})
+	}
+}
+
+func TestTimeControlCanonical(t *testing.T) {
+	tests := []struct {
+		spec, want string
+	}{
+		{spec: "5|2", want: "5+2"},
+		{spec: "5+2", want: "5+2"},
+		{spec: " 5|2", want: "5+2"},
+		{spec: "5", want: "5+0"},
+		{spec: "5.0|2.0", want: "5+2"},
+		{spec: "0.5d3", want: "0.5d3"},
+		{spec: "1/60", want: "1/60+0"},
+		{spec: "40/90|30 : 30+30", want: "40/90+30:30+30"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			tc, err := ParseTimeControl(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := tc.Canonical()
+			if got != tt.want {
+				t.Fatalf("ParseTimeControl(%q).Canonical() = %q, want %q", tt.spec, got, tt.want)
+			}
+			again, err := ParseTimeControl(got)
+			if err != nil || again.Canonical() != got {
+				t.Errorf("canonical spec %q does not parse back to itself", got)
+			}
+		})
+	}
+}
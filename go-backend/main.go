@@ -41,6 +41,15 @@ func initApp() {
 	if err := godotenv.Load(); err != nil {
 		log.Println("No .env file found, using system env vars")
 	}
+
+	// CHAT_WORDLIST names a file of words to mask in chat, one per line
+	if path := os.Getenv("CHAT_WORDLIST"); path != "" {
+		filter, err := utils.LoadWordListFilter(path)
+		if err != nil {
+			log.Fatalf("Failed to load chat word list: %v", err)
+		}
+		routes.SetChatFilter(filter)
+	}
 }
 
 // setupRoutes configures all HTTP routes
@@ -65,6 +74,7 @@ func setupAPIRoutes(router *mux.Router) {
 	router.HandleFunc("/api/health", routes.HealthCheck).Methods("GET")
 	router.HandleFunc("/api/createGame", routes.CreateGame).Methods("POST")
 	router.HandleFunc("/api/joinGame/{gameId}", routes.JoinGame).Methods("GET")
+	router.HandleFunc("/api/game/{gameId}", routes.GameSnapshot).Methods("GET")
 }
 
 // setupWebSocketRoutes registers WebSocket endpoints
@@ -72,6 +82,8 @@ func setupWebSocketRoutes(router *mux.Router) {
 	// Create a subrouter for /ws paths to properly extract route variables
 	wsRouter := router.PathPrefix("/ws").Subrouter()
 	wsRouter.HandleFunc("/game/{gameId}", routes.WSEndpoint(GM))
+	wsRouter.HandleFunc("/watch/{gameId}", routes.WatchEndpoint(GM))
+	wsRouter.HandleFunc("/lobby", routes.LobbyEndpoint())
 }
 
 // setupStaticRoutes configures static file serving for the frontend SPA
@@ -0,0 +1,155 @@
+package routes
+
+import (
+	"context"
+	"log"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/corentings/chess/v2"
+	"github.com/yashgadle/go-chess/client"
+	"github.com/yashgadle/go-chess/common"
+	"github.com/yashgadle/go-chess/utils"
+)
+
+// disconnectGrace is how long a player may stay away before their opponent
+// may claim the game. DISCONNECT_GRACE overrides it, e.g. "90s".
+var disconnectGrace = sync.OnceValue(func() time.Duration {
+	return utils.DurationFromEnv("DISCONNECT_GRACE", 60*time.Second)
+})
+
+// awayRetries bounds how often setAway re-reads the game after losing a race
+// with another write
+const awayRetries = 5
+
+// setAway records that color's last connection dropped (away) or that one
+// came back. Any victory claim already offered is withdrawn, since who is
+// left behind may have changed.
+func setAway(ctx context.Context, gameId string, color string, away bool) error {
+	var err error
+	for range awayRetries {
+		var cache *client.RedisCache
+		cache, err = client.GetVal(ctx, gameId)
+		if err != nil {
+			return err
+		}
+		if _, wasAway := cache.DisconnectedAtMs[color]; cache.GameEnd || wasAway == away {
+			return nil
+		}
+
+		disconnected := maps.Clone(cache.DisconnectedAtMs)
+		if disconnected == nil {
+			disconnected = make(map[string]int64)
+		}
+		if away {
+			disconnected[color] = time.Now().UnixMilli()
+		} else {
+			delete(disconnected, color)
+		}
+		noClaim := ""
+		err = client.UpdateVal(ctx, gameId, client.UpdateOptions{
+			DisconnectedAtMs:   &disconnected,
+			VictoryClaimableBy: &noClaim,
+			Version:            &cache.Version,
+		}, nil)
+		if !isConflict(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// claimDeadline returns when the player left behind may claim victory over
+// their absent opponent. ok is false unless exactly one player is away, both
+// have moved, and no claim has been offered yet.
+func claimDeadline(cache *client.RedisCache) (deadline int64, ok bool) {
+	if cache.GameEnd || cache.VictoryClaimableBy != "" || moveNumber(cache.Board) == 1 || len(cache.DisconnectedAtMs) != 1 {
+		return 0, false
+	}
+	for _, awayAtMs := range cache.DisconnectedAtMs {
+		deadline = awayAtMs + disconnectGrace().Milliseconds()
+	}
+	return deadline, true
+}
+
+// offerVictoryClaim tells the player left behind that they may claim the
+// game. The write is conditional on cache.Version, so the opponent coming
+// back first, or another instance offering first, wins.
+func offerVictoryClaim(ctx context.Context, gameId string, cache *client.RedisCache) error {
+	claimant := string(common.White)
+	if _, whiteAway := cache.DisconnectedAtMs[string(common.White)]; whiteAway {
+		claimant = string(common.Black)
+	}
+
+	updates := client.UpdateOptions{
+		VictoryClaimableBy: &claimant,
+		Version:            &cache.Version,
+	}
+	if err := client.UpdateVal(ctx, gameId, updates, nil); err != nil {
+		return err
+	}
+	log.Printf("Game %s: %s may claim victory over an absent opponent", gameId, claimant)
+
+	payload := common.CanClaimVictoryPayload{By: common.PlayerColor(claimant)}
+	return publishEvent(ctx, gameId, "", common.MsgCanClaimVictory, payload)
+}
+
+// requireAbsentOpponent rejects abandonment claims unless the sender's
+// opponent has been away for the whole grace period
+func (a *action) requireAbsentOpponent() error {
+	if err := a.requirePlayer(); err != nil {
+		return err
+	}
+	if a.ply() < 2 {
+		return newActionError(common.ErrInvalidClaim, "the game can still be aborted")
+	}
+	awayAtMs, away := a.cache.DisconnectedAtMs[a.opponentColor()]
+	if !away {
+		return newActionError(common.ErrInvalidClaim, "your opponent is connected")
+	}
+	if leftMs := awayAtMs + disconnectGrace().Milliseconds() - time.Now().UnixMilli(); leftMs > 0 {
+		left := (time.Duration(leftMs) * time.Millisecond).Truncate(time.Second) + time.Second
+		return newActionError(common.ErrInvalidClaim, "your opponent has %s left to reconnect", left)
+	}
+	return nil
+}
+
+func handleClaimVictory(a *action) error {
+	if err := a.requireAbsentOpponent(); err != nil {
+		return err
+	}
+	return endGame(a.ctx, a.gameId, a.cache.Version, a.abandonedResult(true))
+}
+
+func handleClaimDrawAbandon(a *action) error {
+	if err := a.requireAbsentOpponent(); err != nil {
+		return err
+	}
+	return endGame(a.ctx, a.gameId, a.cache.Version, a.abandonedResult(false))
+}
+
+// abandonedResult ends the game because the opponent left: a win for the
+// sender if they asked for one, or a draw. Like a loss on time, a win is a
+// draw instead if the sender has no mating material.
+func (a *action) abandonedResult(win bool) common.GameResult {
+	whiteTimeMs, blackTimeMs := clocksAt(a.cache, time.Now().UnixMilli())
+	result := common.GameResult{
+		Method:      common.Abandonment,
+		FEN:         a.game.FEN(),
+		WhiteTimeMs: whiteTimeMs,
+		BlackTimeMs: blackTimeMs,
+	}
+
+	claimant, outcome := chess.White, chess.WhiteWon
+	if a.user.Color == string(common.Black) {
+		claimant, outcome = chess.Black, chess.BlackWon
+	}
+	if !win || !utils.CanCheckmate(a.game.Position(), claimant) {
+		outcome = chess.Draw
+	} else {
+		result.Winner = common.PlayerColor(a.user.Color)
+	}
+	result.PGN = utils.PGNWithResult(a.game, outcome, "abandoned")
+	return result
+}
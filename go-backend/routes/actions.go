@@ -0,0 +1,653 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"maps"
+	"strings"
+	"time"
+
+	"github.com/corentings/chess/v2"
+	"github.com/yashgadle/go-chess/client"
+	"github.com/yashgadle/go-chess/common"
+	"github.com/yashgadle/go-chess/utils"
+)
+
+// action is a single client message being applied to the stored game
+type action struct {
+	ctx    context.Context
+	p      *common.Player
+	gameId string
+	msg    common.WSMessage
+	cache  *client.RedisCache
+	game   *chess.Game
+	// user is the sender as recorded in the game
+	user client.User
+}
+
+// handleMessage loads the game and dispatches msg to its handler.
+// Handlers report rejected actions as *actionError.
+func handleMessage(ctx context.Context, p *common.Player, gameId string, msg common.WSMessage) error {
+	// Protocol messages don't touch the game
+	switch msg.Type {
+	case common.MsgAck:
+		return handleAck(p, msg)
+	case common.MsgResumeFrom:
+		return handleResumeFrom(ctx, p, gameId, msg)
+	case common.MsgChatMute:
+		// Unmuting sends the players' room, which only they may read
+		if err := requireSeated(p); err != nil {
+			return err
+		}
+		return handleChatMute(ctx, p.Socket, gameId, p.Id, common.PlayersRoom, msg)
+	}
+
+	gameCache, err := client.GetVal(ctx, gameId)
+	if err != nil {
+		return err
+	}
+	err = applyAction(ctx, p, gameId, msg, gameCache)
+	if !isConflict(err) {
+		return err
+	}
+
+	// Presence changes and victory claim offers bump the version too, so
+	// losing the race doesn't mean the game moved on. If no move was made or
+	// taken back and the game is still on, msg is applied once more to the
+	// fresh game; otherwise the sender is handed the new state.
+	fresh, freshErr := client.GetVal(ctx, gameId)
+	if freshErr != nil {
+		return freshErr
+	}
+	if fresh.PGN != gameCache.PGN || fresh.GameEnd != gameCache.GameEnd {
+		return err
+	}
+	return applyAction(ctx, p, gameId, msg, fresh)
+}
+
+// applyAction dispatches msg to its handler against gameCache, as read
+func applyAction(ctx context.Context, p *common.Player, gameId string, msg common.WSMessage, gameCache *client.RedisCache) error {
+	var user client.User
+	for _, u := range gameCache.Users {
+		if u.Id == p.Id {
+			user = u
+		}
+	}
+
+	pgnReader := strings.NewReader(gameCache.PGN)
+	pgn, err := chess.PGN(pgnReader)
+	if err != nil {
+		log.Println("Invalid PGN")
+		return newActionError(common.ErrInvalidPGN, "stored game could not be read")
+	}
+
+	a := &action{
+		ctx:    ctx,
+		p:      p,
+		gameId: gameId,
+		msg:    msg,
+		cache:  gameCache,
+		game:   chess.NewGame(pgn),
+		user:   user,
+	}
+
+	switch msg.Type {
+	case common.MsgMove:
+		return handleMove(a)
+	case common.MsgResign:
+		return handleResign(a)
+	case common.MsgDrawOffer:
+		return handleDrawOffer(a)
+	case common.MsgDrawAccept:
+		return handleDrawAccept(a)
+	case common.MsgDrawDecline:
+		return handleDrawDecline(a)
+	case common.MsgClaimDraw:
+		return handleClaimDraw(a)
+	case common.MsgAbort:
+		return handleAbort(a)
+	case common.MsgClaimVictory:
+		return handleClaimVictory(a)
+	case common.MsgClaimDrawAbandon:
+		return handleClaimDrawAbandon(a)
+	case common.MsgRematchOffer:
+		return handleRematchOffer(a)
+	case common.MsgRematchAccept:
+		return handleRematchAccept(a)
+	case common.MsgSyncRequest:
+		if err := a.requireSeat(); err != nil {
+			return err
+		}
+		sendGameState(a.ctx, a.p, a.gameId)
+		return nil
+	case common.MsgTakebackRequest:
+		return handleTakebackRequest(a)
+	case common.MsgTakebackAccept:
+		return handleTakebackAccept(a)
+	case common.MsgTakebackDecline:
+		return handleTakebackDecline(a)
+	case common.MsgChat:
+		return handleChat(a)
+	default:
+		return newActionError(common.ErrUnknownType, "unknown message type %q", msg.Type)
+	}
+}
+
+// requirePlayer rejects actions from anyone who isn't playing in the game,
+// and any action once the game is over
+func (a *action) requirePlayer() error {
+	if err := a.requireSeat(); err != nil {
+		return err
+	}
+	if a.cache.GameEnd {
+		return newActionError(common.ErrGameOver, "the game is over")
+	}
+	return nil
+}
+
+// requireSeat rejects anyone who isn't playing in the game, whether or not
+// it is over
+func (a *action) requireSeat() error {
+	if a.user.Id == "" || (a.user.Color != string(common.White) && a.user.Color != string(common.Black)) {
+		return newActionError(common.ErrNotPlayer, "you are not playing in this game")
+	}
+	return nil
+}
+
+// requireSeated is requireSeat for messages handled without loading the
+// game, going by the color p connected with
+func requireSeated(p *common.Player) error {
+	if !p.Seated() {
+		return newActionError(common.ErrNotPlayer, "you are not playing in this game")
+	}
+	return nil
+}
+
+// opponentColor returns the color of the sender's opponent
+func (a *action) opponentColor() string {
+	if a.user.Color == string(common.White) {
+		return string(common.Black)
+	}
+	return string(common.White)
+}
+
+// ply returns the number of half moves played so far
+func (a *action) ply() int {
+	return len(a.game.Moves())
+}
+
+// requireTurn rejects actions from the player who isn't on move
+func (a *action) requireTurn() error {
+	if err := a.requirePlayer(); err != nil {
+		return err
+	}
+	if a.game.Position().Turn().String() != a.user.Color {
+		return newActionError(common.ErrNotYourTurn, "it is not your turn")
+	}
+	return nil
+}
+
+func handleMove(a *action) error {
+	if err := a.requireTurn(); err != nil {
+		return err
+	}
+
+	var movePayload common.MovePayload
+	if err := json.Unmarshal(a.msg.Data, &movePayload); err != nil {
+		return newActionError(common.ErrBadMessage, "invalid move payload")
+	}
+
+	gameCache := a.cache
+	game := a.game
+
+	//	Clock logic
+	now := time.Now().UnixMilli()
+	turn := game.Position().Turn()
+	whiteTimeMs := gameCache.WhiteTimeMs
+	blackTimeMs := gameCache.BlackTimeMs
+	lastMoveAtMs := now
+
+	// The abort timer may not have fired yet either
+	if abortAt, ok := abortDeadline(gameCache); ok && now > abortAt {
+		return abortOnTimeout(a.ctx, a.gameId, gameCache)
+	}
+
+	// Handle first move (LastMoveAtMs is 0) - don't deduct time
+	firstMove := gameCache.LastMoveAtMs == 0
+	moveTimeMs := int64(0)
+	if !firstMove {
+		// Calculate move time for subsequent moves
+		moveTimeMs = now - gameCache.LastMoveAtMs
+
+		// The flag timer may not have fired yet, so check here as well
+		if now > flagDeadline(gameCache) {
+			return endOnTime(a.ctx, a.gameId, gameCache)
+		}
+	}
+
+	// Charge the mover according to the time control's clock mode
+	tc := gameCache.TimeControl
+	number := moveNumber(gameCache.Board)
+	if turn == chess.White {
+		whiteTimeMs = tc.AfterMove(whiteTimeMs, moveTimeMs, number)
+	} else {
+		blackTimeMs = tc.AfterMove(blackTimeMs, moveTimeMs, number)
+	}
+
+	// Make move
+	move, err := utils.FindMove(game, movePayload.FromSquare, movePayload.ToSquare, movePayload.Promotion)
+	if err == nil {
+		err = game.Move(move, nil)
+	}
+	if err != nil {
+		return newActionError(common.ErrIllegalMove, "%v", err)
+	}
+
+	// Remember the clocks before this move so a takeback can restore them
+	clockHistory := append(gameCache.ClockHistory, client.ClockSnapshot{
+		WhiteTimeMs:  gameCache.WhiteTimeMs,
+		BlackTimeMs:  gameCache.BlackTimeMs,
+		LastMoveAtMs: gameCache.LastMoveAtMs,
+	})
+
+	board := game.FEN()
+	pgn := game.String()
+	updates := client.UpdateOptions{
+		Board:        &board,
+		PGN:          &pgn,
+		WhiteTimeMs:  &whiteTimeMs,
+		BlackTimeMs:  &blackTimeMs,
+		LastMoveAtMs: &lastMoveAtMs,
+		ClockHistory: &clockHistory,
+		Version:      &gameCache.Version,
+	}
+
+	// A move makes any pending takeback request stale
+	if gameCache.Takeback.By != "" {
+		updates.Takeback = &client.TakebackRequest{}
+	}
+
+	// Moving instead of answering the opponent's draw offer declines it
+	offerExpired := gameCache.DrawOffer.By == a.opponentColor()
+	if offerExpired {
+		updates.DrawOffer = &client.DrawOffer{}
+	}
+
+	// Checkmate, stalemate and the automatic draws end the game with this move
+	var result *common.GameResult
+	if game.Outcome() != chess.NoOutcome {
+		log.Println("Game has ended")
+		result = &common.GameResult{
+			Winner:      utils.Winner(game.Outcome()),
+			Method:      utils.GameOverType(game.Method()),
+			FEN:         board,
+			PGN:         pgn,
+			WhiteTimeMs: whiteTimeMs,
+			BlackTimeMs: blackTimeMs,
+		}
+		setResult(&updates, result)
+	}
+
+	// Write everything in one compare-and-set so a concurrent move or
+	// resign on another instance can't be silently overwritten
+	if err := client.UpdateVal(a.ctx, a.gameId, updates, nil); err != nil {
+		return err
+	}
+
+	// Restart the flag timer for the side now to move
+	if result == nil {
+		next := *gameCache
+		next.Board = board
+		next.WhiteTimeMs = whiteTimeMs
+		next.BlackTimeMs = blackTimeMs
+		next.LastMoveAtMs = lastMoveAtMs
+		flagTimers.Arm(a.gameId, &next)
+	}
+
+	if firstMove {
+		// First move: just set the timestamp, don't deduct time
+		startClockPayload := common.StartClockPayload{
+			WhiteTimeMs:  whiteTimeMs,
+			BlackTimeMs:  blackTimeMs,
+			LastMoveAtMs: lastMoveAtMs,
+		}
+		err = publishEvent(client.Ctx, a.gameId, "", common.MsgStartClock, startClockPayload)
+		if err != nil {
+			log.Println("Error publishing start clock event to Redis pub/sub")
+			return err
+		}
+	}
+
+	// Publish move event to Redis pub/sub with clock times
+	movePayloadWithTime := common.MovePayload{
+		FromSquare:  movePayload.FromSquare,
+		ToSquare:    movePayload.ToSquare,
+		Promotion:   move.Promo().String(),
+		WhiteTimeMs: whiteTimeMs,
+		BlackTimeMs: blackTimeMs,
+	}
+	err = publishEvent(a.ctx, a.gameId, a.p.Id, common.MsgMove, movePayloadWithTime)
+	if err != nil {
+		log.Println("Error publishing move event to Redis pub/sub")
+		return err
+	}
+
+	if offerExpired {
+		err = publishEvent(a.ctx, a.gameId, "", common.MsgDrawDecline, common.DrawDeclinePayload{Expired: true})
+		if err != nil {
+			return err
+		}
+	}
+
+	if result != nil {
+		return announceGameOver(a.ctx, a.gameId, *result)
+	}
+	return nil
+}
+
+func handleResign(a *action) error {
+	if err := a.requirePlayer(); err != nil {
+		return err
+	}
+	game := a.game
+
+	if a.user.Color == string(common.White) {
+		game.Resign(chess.White)
+	} else {
+		game.Resign(chess.Black)
+	}
+	return endGame(a.ctx, a.gameId, a.cache.Version, a.result(common.Resignation))
+}
+
+// result builds the result of the game as it now stands, with both clocks
+// read at the current time
+func (a *action) result(method common.GOType) common.GameResult {
+	whiteTimeMs, blackTimeMs := clocksAt(a.cache, time.Now().UnixMilli())
+	return common.GameResult{
+		Winner:      utils.Winner(a.game.Outcome()),
+		Method:      method,
+		FEN:         a.game.FEN(),
+		PGN:         a.game.String(),
+		WhiteTimeMs: whiteTimeMs,
+		BlackTimeMs: blackTimeMs,
+	}
+}
+
+// drawOfferCooldownPlies is how many half moves must pass before the same
+// player may offer a draw again
+const drawOfferCooldownPlies = 6
+
+func handleDrawOffer(a *action) error {
+	if err := a.requirePlayer(); err != nil {
+		return err
+	}
+
+	switch a.cache.DrawOffer.By {
+	case a.user.Color:
+		return newActionError(common.ErrInvalidDraw, "you already offered a draw")
+	case a.opponentColor():
+		return newActionError(common.ErrInvalidDraw, "your opponent offered a draw, accept or decline it")
+	}
+
+	ply := a.ply()
+	if last, ok := a.cache.LastDrawOfferPly[a.user.Color]; ok && ply-last < drawOfferCooldownPlies {
+		return newActionError(common.ErrRateLimited, "wait a few moves before offering another draw")
+	}
+
+	lastOfferPly := maps.Clone(a.cache.LastDrawOfferPly)
+	if lastOfferPly == nil {
+		lastOfferPly = make(map[string]int)
+	}
+	lastOfferPly[a.user.Color] = ply
+
+	err := client.UpdateVal(a.ctx, a.gameId, client.UpdateOptions{
+		DrawOffer:        &client.DrawOffer{By: a.user.Color, Ply: ply},
+		LastDrawOfferPly: &lastOfferPly,
+		Version:          &a.cache.Version,
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	drawOfferPayload := common.DrawOfferPayload{
+		By: common.PlayerColor(a.user.Color),
+	}
+	return publishEvent(a.ctx, a.gameId, a.p.Id, common.MsgDrawOffer, drawOfferPayload)
+}
+
+// requireOpponentOffer rejects answers to a draw offer the opponent hasn't made
+func (a *action) requireOpponentOffer() error {
+	if err := a.requirePlayer(); err != nil {
+		return err
+	}
+	if a.cache.DrawOffer.By != a.opponentColor() {
+		return newActionError(common.ErrInvalidDraw, "there is no draw offer from your opponent")
+	}
+	return nil
+}
+
+func handleDrawDecline(a *action) error {
+	if err := a.requireOpponentOffer(); err != nil {
+		return err
+	}
+
+	err := client.UpdateVal(a.ctx, a.gameId, client.UpdateOptions{
+		DrawOffer: &client.DrawOffer{},
+		Version:   &a.cache.Version,
+	}, nil)
+	if err != nil {
+		return err
+	}
+	return publishEvent(a.ctx, a.gameId, a.p.Id, common.MsgDrawDecline, common.DrawDeclinePayload{})
+}
+
+func handleDrawAccept(a *action) error {
+	if err := a.requireOpponentOffer(); err != nil {
+		return err
+	}
+	if err := a.game.Draw(chess.DrawOffer); err != nil {
+		return newActionError(common.ErrInvalidDraw, "%v", err)
+	}
+	return endGame(a.ctx, a.gameId, a.cache.Version, a.result(common.DrawByAgreement))
+}
+
+// takebackPlies returns how many half moves must be undone to get back to
+// the requester's last move: one if they just moved, two if it's their turn
+func (a *action) takebackPlies() int {
+	if a.game.Position().Turn().String() == a.user.Color {
+		return 2
+	}
+	return 1
+}
+
+func handleTakebackRequest(a *action) error {
+	if err := a.requirePlayer(); err != nil {
+		return err
+	}
+
+	switch a.cache.Takeback.By {
+	case a.user.Color:
+		return newActionError(common.ErrInvalidTakeback, "you already asked for a takeback")
+	case a.opponentColor():
+		return newActionError(common.ErrInvalidTakeback, "your opponent asked for a takeback, accept or decline it")
+	}
+
+	plies := a.takebackPlies()
+	if plies > a.ply() {
+		return newActionError(common.ErrInvalidTakeback, "you have no move to take back")
+	}
+
+	err := client.UpdateVal(a.ctx, a.gameId, client.UpdateOptions{
+		Takeback: &client.TakebackRequest{By: a.user.Color, Ply: a.ply()},
+		Version:  &a.cache.Version,
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	takebackPayload := common.TakebackPayload{
+		By:    common.PlayerColor(a.user.Color),
+		Plies: plies,
+	}
+	return publishEvent(a.ctx, a.gameId, a.p.Id, common.MsgTakebackRequest, takebackPayload)
+}
+
+// requireOpponentTakeback rejects answers to a takeback the opponent hasn't asked for
+func (a *action) requireOpponentTakeback() error {
+	if err := a.requirePlayer(); err != nil {
+		return err
+	}
+	if a.cache.Takeback.By != a.opponentColor() || a.cache.Takeback.Ply != a.ply() {
+		return newActionError(common.ErrInvalidTakeback, "there is no takeback request from your opponent")
+	}
+	return nil
+}
+
+func handleTakebackDecline(a *action) error {
+	if err := a.requireOpponentTakeback(); err != nil {
+		return err
+	}
+
+	err := client.UpdateVal(a.ctx, a.gameId, client.UpdateOptions{
+		Takeback: &client.TakebackRequest{},
+		Version:  &a.cache.Version,
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	takebackPayload := common.TakebackPayload{
+		By: common.PlayerColor(a.opponentColor()),
+	}
+	return publishEvent(a.ctx, a.gameId, a.p.Id, common.MsgTakebackDecline, takebackPayload)
+}
+
+func handleTakebackAccept(a *action) error {
+	if err := a.requireOpponentTakeback(); err != nil {
+		return err
+	}
+	gameCache := a.cache
+
+	// The accepting player is on move iff the requester just moved
+	plies := 2
+	if a.game.Position().Turn().String() == a.user.Color {
+		plies = 1
+	}
+
+	game, err := utils.Rewind(a.game, plies)
+	if err != nil {
+		return newActionError(common.ErrInvalidTakeback, "%v", err)
+	}
+
+	// Put both clocks back to where they were before the first undone move.
+	// Games created before clock history was kept fall back to current clocks.
+	whiteTimeMs := gameCache.WhiteTimeMs
+	blackTimeMs := gameCache.BlackTimeMs
+	clockHistory := gameCache.ClockHistory
+	if n := len(clockHistory); n >= plies {
+		snapshot := clockHistory[n-plies]
+		whiteTimeMs = snapshot.WhiteTimeMs
+		blackTimeMs = snapshot.BlackTimeMs
+		clockHistory = clockHistory[:n-plies]
+	} else {
+		clockHistory = nil
+	}
+
+	// The clock of the side now to move restarts from now; back at the
+	// start position the clocks wait for the first move again
+	now := time.Now().UnixMilli()
+	lastMoveAtMs := now
+	startedAtMs := gameCache.StartedAtMs
+	if len(game.Moves()) == 0 {
+		lastMoveAtMs, startedAtMs = 0, now
+	}
+
+	board := game.FEN()
+	pgn := game.String()
+	updates := client.UpdateOptions{
+		Board:        &board,
+		PGN:          &pgn,
+		WhiteTimeMs:  &whiteTimeMs,
+		BlackTimeMs:  &blackTimeMs,
+		LastMoveAtMs: &lastMoveAtMs,
+		StartedAtMs:  &startedAtMs,
+		ClockHistory: &clockHistory,
+		Takeback:     &client.TakebackRequest{},
+		DrawOffer:    &client.DrawOffer{},
+		Version:      &gameCache.Version,
+	}
+	if err := client.UpdateVal(a.ctx, a.gameId, updates, nil); err != nil {
+		return err
+	}
+
+	next := *gameCache
+	next.Board = board
+	next.WhiteTimeMs = whiteTimeMs
+	next.BlackTimeMs = blackTimeMs
+	next.LastMoveAtMs = lastMoveAtMs
+	next.StartedAtMs = startedAtMs
+	next.PGN = pgn
+	next.ClockHistory = clockHistory
+	next.Takeback = client.TakebackRequest{}
+	next.DrawOffer = client.DrawOffer{}
+	flagTimers.Arm(a.gameId, &next)
+
+	// Both players get the full rewound state
+	return publishEvent(a.ctx, a.gameId, "", common.MsgGameState, newGameState(&next, now))
+}
+
+// claimableDraws maps the draws a player may claim to the library's methods
+var claimableDraws = map[common.GOType]chess.Method{
+	common.ThreefoldRepetition: chess.ThreefoldRepetition,
+	common.FiftyMoveRule:       chess.FiftyMoveRule,
+}
+
+func handleClaimDraw(a *action) error {
+	if err := a.requirePlayer(); err != nil {
+		return err
+	}
+
+	var claim common.ClaimDrawPayload
+	if len(a.msg.Data) > 0 {
+		if err := json.Unmarshal(a.msg.Data, &claim); err != nil {
+			return newActionError(common.ErrBadMessage, "invalid claim_draw payload")
+		}
+	}
+	if _, ok := claimableDraws[claim.Reason]; claim.Reason != "" && !ok {
+		return newActionError(common.ErrInvalidDraw, "%q is not a draw that can be claimed", claim.Reason)
+	}
+
+	// Pick the requested draw, or the first one the position allows
+	game := a.game
+	method := chess.NoMethod
+	for _, eligible := range game.EligibleDraws() {
+		if eligible == chess.DrawOffer {
+			continue
+		}
+		if claim.Reason == "" || claimableDraws[claim.Reason] == eligible {
+			method = eligible
+			break
+		}
+	}
+	if method == chess.NoMethod {
+		if claim.Reason != "" {
+			return newActionError(common.ErrInvalidDraw, "the position does not allow a %s claim", claim.Reason)
+		}
+		return newActionError(common.ErrInvalidDraw, "there is no draw to claim in this position")
+	}
+	if err := game.Draw(method); err != nil {
+		return newActionError(common.ErrInvalidDraw, "%v", err)
+	}
+	return endGame(a.ctx, a.gameId, a.cache.Version, a.result(utils.GameOverType(method)))
+}
+
+func handleAbort(a *action) error {
+	if err := a.requirePlayer(); err != nil {
+		return err
+	}
+	if a.ply() >= 2 {
+		return newActionError(common.ErrInvalidAbort, "the game can only be aborted before both players have moved")
+	}
+	return endGame(a.ctx, a.gameId, a.cache.Version, abortedResult(a.game, a.cache))
+}
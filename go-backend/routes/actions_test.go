@@ -0,0 +1,130 @@
+package routes
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/yashgadle/go-chess/client"
+	"github.com/yashgadle/go-chess/common"
+)
+
+// startTestGame creates a 5|2 game and connects both players to it
+func startTestGame(t *testing.T) (gameId string, white, black *testConn) {
+	t.Helper()
+	gameId = createTestGame(t, GameType{Color: "w", Time: common.Time5_2})
+	white = dialTest(t, "/ws/game/"+gameId, joinTestGame(t, gameId, common.White))
+	black = dialTest(t, "/ws/game/"+gameId, joinTestGame(t, gameId, common.Black))
+	white.expect(t, common.MsgGameState)
+	black.expect(t, common.MsgGameState)
+	return gameId, white, black
+}
+
+// playMoves plays moves, given as from and to squares, starting with mover
+func playMoves(t *testing.T, mover, opponent *testConn, moves ...[2]string) {
+	t.Helper()
+	for _, m := range moves {
+		mover.send(t, common.MsgMove, common.MovePayload{FromSquare: m[0], ToSquare: m[1]})
+		mover.expect(t, common.MsgAck)
+		opponent.expect(t, common.MsgMove)
+		mover, opponent = opponent, mover
+	}
+}
+
+func TestMovesOnlyOnYourTurn(t *testing.T) {
+	gameId, white, black := startTestGame(t)
+	defer white.close()
+	defer black.close()
+
+	black.send(t, common.MsgMove, common.MovePayload{FromSquare: "e7", ToSquare: "e5"})
+	black.expectError(t, common.ErrNotYourTurn)
+
+	playMoves(t, white, black, [2]string{"e2", "e4"})
+	white.send(t, common.MsgMove, common.MovePayload{FromSquare: "d2", ToSquare: "d4"})
+	white.expectError(t, common.ErrNotYourTurn)
+
+	cache, err := client.GetVal(client.Ctx, gameId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "rnbqkbnr/pppppppp/8/8/4P3/8/PPPP1PPP/RNBQKBNR b KQkq e3 0 1"; cache.Board != want {
+		t.Errorf("board is %s, want %s", cache.Board, want)
+	}
+}
+
+func TestDrawOfferRules(t *testing.T) {
+	_, white, black := startTestGame(t)
+	defer white.close()
+	defer black.close()
+
+	black.send(t, common.MsgDrawAccept, nil)
+	black.expectError(t, common.ErrInvalidDraw)
+
+	white.send(t, common.MsgDrawOffer, nil)
+	white.expect(t, common.MsgAck)
+	black.expect(t, common.MsgDrawOffer)
+	white.send(t, common.MsgDrawOffer, nil)
+	white.expectError(t, common.ErrInvalidDraw)
+	black.send(t, common.MsgDrawOffer, nil)
+	black.expectError(t, common.ErrInvalidDraw)
+
+	black.send(t, common.MsgDrawDecline, nil)
+	black.expect(t, common.MsgAck)
+	white.expect(t, common.MsgDrawDecline)
+
+	// An offer may only be repeated once drawOfferCooldownPlies have passed
+	white.send(t, common.MsgDrawOffer, nil)
+	white.expectError(t, common.ErrRateLimited)
+	playMoves(t, white, black,
+		[2]string{"g1", "f3"}, [2]string{"g8", "f6"},
+		[2]string{"f3", "g1"}, [2]string{"f6", "g8"},
+		[2]string{"g1", "f3"}, [2]string{"g8", "f6"},
+	)
+	white.send(t, common.MsgDrawOffer, nil)
+	white.expect(t, common.MsgAck)
+	black.expect(t, common.MsgDrawOffer)
+
+	black.send(t, common.MsgDrawAccept, nil)
+	for _, c := range []*testConn{white, black} {
+		var result common.GameResult
+		if err := json.Unmarshal(c.expect(t, common.MsgGameOver).Data, &result); err != nil {
+			t.Fatal(err)
+		}
+		if result.Winner != "" || result.Method != common.DrawByAgreement {
+			t.Errorf("game over: winner %q by %q, want a draw by %q", result.Winner, result.Method, common.DrawByAgreement)
+		}
+	}
+}
+
+func TestTakebackRestoresClocks(t *testing.T) {
+	gameId, white, black := startTestGame(t)
+	defer white.close()
+	defer black.close()
+
+	playMoves(t, white, black, [2]string{"e2", "e4"}, [2]string{"e7", "e5"}, [2]string{"g1", "f3"})
+
+	// Both players have since used up most of their time
+	whiteTimeMs, blackTimeMs := int64(100_000), int64(90_000)
+	err := client.UpdateVal(client.Ctx, gameId, client.UpdateOptions{WhiteTimeMs: &whiteTimeMs, BlackTimeMs: &blackTimeMs}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Black is on move, so their takeback undoes Nf3 and e5
+	black.send(t, common.MsgTakebackRequest, nil)
+	black.expect(t, common.MsgAck)
+	white.expect(t, common.MsgTakebackRequest)
+	white.send(t, common.MsgTakebackAccept, nil)
+
+	var state common.GameStatePayload
+	if err := json.Unmarshal(black.expect(t, common.MsgGameState).Data, &state); err != nil {
+		t.Fatal(err)
+	}
+	if want := "rnbqkbnr/pppppppp/8/8/4P3/8/PPPP1PPP/RNBQKBNR b KQkq e3 0 1"; state.FEN != want {
+		t.Errorf("rewound to %s, want %s", state.FEN, want)
+	}
+	// The clocks read as they did before e5: white has the increment from
+	// e4, black barely anything used
+	if state.WhiteTimeMs < 300_000 || state.BlackTimeMs < 299_000 {
+		t.Errorf("clocks after the takeback: white %d, black %d, want them as before e5", state.WhiteTimeMs, state.BlackTimeMs)
+	}
+}
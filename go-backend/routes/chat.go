@@ -0,0 +1,147 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/yashgadle/go-chess/client"
+	"github.com/yashgadle/go-chess/common"
+	"github.com/yashgadle/go-chess/utils"
+)
+
+// maxChatLength is the longest chat message accepted, in characters
+const maxChatLength = 280
+
+// chatRateLimit is how many messages a user may send to a game's chat
+// within chatRateWindow, counted from the first of them
+const (
+	chatRateLimit  = 5
+	chatRateWindow = 10 * time.Second
+)
+
+// chatFilter moderates chat before it is relayed; nil lets everything through
+var chatFilter utils.ChatFilter
+
+// SetChatFilter installs f to moderate every chat message.
+// Call it before serving any request.
+func SetChatFilter(f utils.ChatFilter) {
+	chatFilter = f
+}
+
+// sendChat checks and moderates a chat message from userId, stores it with
+// the game and relays it to room. color is empty for spectators.
+func sendChat(ctx context.Context, gameId string, room common.ChatRoom, userId string, color common.PlayerColor, data json.RawMessage) error {
+	var chat common.ChatPayload
+	if err := json.Unmarshal(data, &chat); err != nil {
+		return newActionError(common.ErrBadMessage, "invalid chat payload")
+	}
+
+	text := strings.TrimSpace(chat.Text)
+	if text == "" {
+		return newActionError(common.ErrInvalidChat, "message is empty")
+	}
+	if utf8.RuneCountInString(text) > maxChatLength {
+		return newActionError(common.ErrInvalidChat, "message is longer than %d characters", maxChatLength)
+	}
+	// The count is kept in the store, so the limit holds across instances
+	sent, err := client.CountChat(ctx, gameId, userId, chatRateWindow)
+	if err != nil {
+		return err
+	}
+	if sent > chatRateLimit {
+		return newActionError(common.ErrRateLimited, "you are sending messages too quickly")
+	}
+	if chatFilter != nil {
+		filtered, err := chatFilter.Filter(text)
+		if err != nil {
+			return newActionError(common.ErrInvalidChat, "message was not allowed: %v", err)
+		}
+		text = filtered
+	}
+
+	payload := common.ChatPayload{
+		Room:     room,
+		Color:    color,
+		Text:     text,
+		SentAtMs: time.Now().UnixMilli(),
+	}
+	msg, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if err := client.AppendChat(ctx, gameId, string(room), msg); err != nil {
+		return err
+	}
+	return publishEvent(ctx, gameId, userId, common.MsgChat, payload)
+}
+
+// handleChat relays a message to the players' room. Players may keep
+// chatting once the game is over.
+func handleChat(a *action) error {
+	if err := a.requireSeat(); err != nil {
+		return err
+	}
+	return sendChat(a.ctx, a.gameId, common.PlayersRoom, a.user.Id, common.PlayerColor(a.user.Color), a.msg.Data)
+}
+
+// handleChatMute turns chat from everyone else on or off for s, and
+// remembers the choice for userId's later connections to the game. Unmuting
+// sends the messages of room that were missed.
+func handleChatMute(ctx context.Context, s *common.Socket, gameId string, userId string, room common.ChatRoom, msg common.WSMessage) error {
+	var mute common.ChatMutePayload
+	if err := json.Unmarshal(msg.Data, &mute); err != nil {
+		return newActionError(common.ErrBadMessage, "invalid chat_mute payload")
+	}
+
+	s.ChatMuted.Store(mute.Muted)
+	if userId != "" {
+		if err := client.SetChatMuted(ctx, gameId, userId, mute.Muted); err != nil {
+			return err
+		}
+	}
+	utils.WriteSignal(s, common.MsgChatMute, mute)
+	if !mute.Muted {
+		sendChatLog(ctx, s, gameId, room)
+	}
+	return nil
+}
+
+// sendChatHistory restores userId's mute choice on s, then sends it the kept
+// messages of room, or the mute if chat is muted
+func sendChatHistory(ctx context.Context, s *common.Socket, gameId string, userId string, room common.ChatRoom) {
+	if userId != "" {
+		muted, err := client.ChatMuted(ctx, gameId, userId)
+		if err != nil {
+			log.Printf("Failed to read chat mute for game %s: %v", gameId, err)
+		}
+		s.ChatMuted.Store(muted)
+	}
+	if s.ChatMuted.Load() {
+		utils.WriteSignal(s, common.MsgChatMute, common.ChatMutePayload{Muted: true})
+		return
+	}
+	sendChatLog(ctx, s, gameId, room)
+}
+
+// sendChatLog sends s the kept messages of room
+func sendChatLog(ctx context.Context, s *common.Socket, gameId string, room common.ChatRoom) {
+	chatLog, err := client.ChatLog(ctx, gameId, string(room))
+	if err != nil {
+		log.Printf("Failed to read chat for game %s: %v", gameId, err)
+		return
+	}
+	history := common.ChatHistoryPayload{Room: room, Messages: []common.ChatPayload{}}
+	for _, raw := range chatLog {
+		var chat common.ChatPayload
+		if err := json.Unmarshal(raw, &chat); err != nil {
+			log.Printf("Failed to unmarshal chat message: %v", err)
+			continue
+		}
+		history.Messages = append(history.Messages, chat)
+	}
+	utils.WriteSignal(s, common.MsgChatHistory, history)
+}
@@ -0,0 +1,286 @@
+package routes
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/corentings/chess/v2"
+	"github.com/yashgadle/go-chess/client"
+	"github.com/yashgadle/go-chess/common"
+	"github.com/yashgadle/go-chess/utils"
+)
+
+// flagScheduler ends games when the side to move runs out of time, or never
+// makes their first move, even if that player never sends another message.
+// It also tells a player when they may claim victory over an absent opponent.
+// Every instance with a player in the game keeps its own timer; the versioned
+// writes in endOnTime, abortOnTimeout and offerVictoryClaim make sure only one
+// of them acts.
+type flagScheduler struct {
+	mu     sync.Mutex
+	timers map[string]*time.Timer
+}
+
+var flagTimers = &flagScheduler{
+	timers: make(map[string]*time.Timer),
+}
+
+// Arm (re)schedules the check for gameId based on cache.
+// Games that are over, or waiting for players to join, have no timer.
+func (fs *flagScheduler) Arm(gameId string, cache *client.RedisCache) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if t := fs.timers[gameId]; t != nil {
+		t.Stop()
+		delete(fs.timers, gameId)
+	}
+	deadline, ok := nextDeadline(cache)
+	if !ok {
+		return
+	}
+
+	delay := time.Until(time.UnixMilli(deadline))
+	var t *time.Timer
+	t = time.AfterFunc(max(delay, 0), func() {
+		fs.mu.Lock()
+		current := fs.timers[gameId] == t
+		if current {
+			delete(fs.timers, gameId)
+		}
+		fs.mu.Unlock()
+
+		if current {
+			fs.check(gameId)
+		}
+	})
+	fs.timers[gameId] = t
+}
+
+// Stop cancels any pending flag check for gameId
+func (fs *flagScheduler) Stop(gameId string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if t := fs.timers[gameId]; t != nil {
+		t.Stop()
+		delete(fs.timers, gameId)
+	}
+}
+
+// Refresh re-reads the game and re-arms its timer
+func (fs *flagScheduler) Refresh(gameId string) {
+	cache, err := client.GetVal(client.Ctx, gameId)
+	if err != nil {
+		log.Printf("Flag timer: game %s not found: %v", gameId, err)
+		fs.Stop(gameId)
+		return
+	}
+	fs.Arm(gameId, cache)
+}
+
+// HandleEvent keeps timers in sync with moves made, and players coming and
+// going, on other instances
+func (fs *flagScheduler) HandleEvent(event common.PubSubEvent) {
+	switch event.Type {
+	case common.MsgMove, common.MsgStartClock, common.MsgGameState,
+		common.MsgOpponentDisconnected, common.MsgOpponentReconnected, common.MsgCanClaimVictory:
+		go fs.Refresh(event.GameId)
+	case common.MsgGameOver:
+		fs.Stop(event.GameId)
+	}
+}
+
+// check aborts the game if a first move is overdue, ends it on time if the
+// side to move has really flagged, or offers a victory claim once an absent
+// opponent's grace period is up. If a move landed since the timer was armed
+// it simply follows the new clock.
+func (fs *flagScheduler) check(gameId string) {
+	cache, err := client.GetVal(client.Ctx, gameId)
+	if err != nil {
+		log.Printf("Flag timer: game %s not found: %v", gameId, err)
+		return
+	}
+	if cache.GameEnd {
+		return
+	}
+
+	now := time.Now().UnixMilli()
+	if abortAt, ok := abortDeadline(cache); ok && now > abortAt {
+		err = abortOnTimeout(client.Ctx, gameId, cache)
+	} else if cache.LastMoveAtMs != 0 && now > flagDeadline(cache) {
+		err = endOnTime(client.Ctx, gameId, cache)
+	} else if claimAt, ok := claimDeadline(cache); ok && now >= claimAt {
+		err = offerVictoryClaim(client.Ctx, gameId, cache)
+	} else {
+		fs.Arm(gameId, cache)
+		return
+	}
+
+	if isConflict(err) {
+		// Someone else wrote first: they ended the game, a move landed in
+		// time, or a player came or went. Re-read and decide again.
+		fs.Refresh(gameId)
+		return
+	}
+	if err != nil {
+		log.Printf("Flag timer: failed to end game %s: %v", gameId, err)
+	}
+}
+
+// endOnTime records a loss on time for the side to move, or a draw if the
+// opponent has no mating material, and announces it to both players.
+// The write is conditional on cache.Version so it can't clobber a move that
+// arrived in time.
+func endOnTime(ctx context.Context, gameId string, cache *client.RedisCache) error {
+	pgnOpt, err := chess.PGN(strings.NewReader(cache.PGN))
+	if err != nil {
+		return err
+	}
+	game := chess.NewGame(pgnOpt)
+
+	loser := game.Position().Turn()
+	winner := loser.Other()
+	outcome := chess.WhiteWon
+	if winner == chess.Black {
+		outcome = chess.BlackWon
+	}
+
+	result := common.GameResult{
+		Winner:      common.PlayerColor(winner.String()),
+		Method:      common.Timeout,
+		FEN:         game.FEN(),
+		WhiteTimeMs: cache.WhiteTimeMs,
+		BlackTimeMs: cache.BlackTimeMs,
+	}
+	if !utils.CanCheckmate(game.Position(), winner) {
+		outcome = chess.Draw
+		result.Winner = ""
+	}
+	result.PGN = utils.PGNWithResult(game, outcome, "time forfeit")
+	if loser == chess.White {
+		result.WhiteTimeMs = 0
+	} else {
+		result.BlackTimeMs = 0
+	}
+
+	if err := endGame(ctx, gameId, cache.Version, result); err != nil {
+		return err
+	}
+	log.Printf("Game %s ended on time", gameId)
+	return nil
+}
+
+// abortOnTimeout aborts a game whose side to move let the first-move window
+// run out. Like endOnTime the write is conditional on cache.Version.
+func abortOnTimeout(ctx context.Context, gameId string, cache *client.RedisCache) error {
+	pgnOpt, err := chess.PGN(strings.NewReader(cache.PGN))
+	if err != nil {
+		return err
+	}
+	game := chess.NewGame(pgnOpt)
+
+	if err := endGame(ctx, gameId, cache.Version, abortedResult(game, cache)); err != nil {
+		return err
+	}
+	log.Printf("Game %s aborted, no first move from %s", gameId, sideToMove(cache.Board))
+	return nil
+}
+
+// abortWindow is how long each player has to make their first move before
+// the game is aborted. ABORT_TIMEOUT overrides it, e.g. "45s".
+var abortWindow = sync.OnceValue(func() time.Duration {
+	return utils.DurationFromEnv("ABORT_TIMEOUT", 30*time.Second)
+})
+
+// abortDeadline returns the unix ms at which the game is aborted if the side
+// to move still hasn't made their first move. ok is false once both players
+// have moved, or while white's window hasn't started.
+func abortDeadline(cache *client.RedisCache) (deadline int64, ok bool) {
+	if moveNumber(cache.Board) != 1 {
+		return 0, false
+	}
+	if sideToMove(cache.Board) == common.White {
+		if cache.StartedAtMs == 0 {
+			return 0, false
+		}
+		return cache.StartedAtMs + abortWindow().Milliseconds(), true
+	}
+	return cache.LastMoveAtMs + abortWindow().Milliseconds(), true
+}
+
+// nextDeadline returns when the game next needs checking: the earliest of the
+// abort, flag and victory claim deadlines that apply
+func nextDeadline(cache *client.RedisCache) (deadline int64, ok bool) {
+	if cache.GameEnd {
+		return 0, false
+	}
+	abortAt, aborting := abortDeadline(cache)
+	if cache.LastMoveAtMs == 0 {
+		return abortAt, aborting
+	}
+	deadline = flagDeadline(cache)
+	if aborting {
+		deadline = min(deadline, abortAt)
+	}
+	if claimAt, claimable := claimDeadline(cache); claimable {
+		deadline = min(deadline, claimAt)
+	}
+	return deadline, true
+}
+
+// clocksAt returns both clocks as they read at nowMs, charging the side to
+// move for the time since the last move
+func clocksAt(cache *client.RedisCache, nowMs int64) (whiteTimeMs int64, blackTimeMs int64) {
+	whiteTimeMs, blackTimeMs = cache.WhiteTimeMs, cache.BlackTimeMs
+	if cache.GameEnd || cache.LastMoveAtMs == 0 {
+		return whiteTimeMs, blackTimeMs
+	}
+
+	// The clock shows what is left of the allowance, but with a delay it
+	// doesn't start running until the delay is used up
+	left := max(flagDeadline(cache)-nowMs, 0)
+	if sideToMove(cache.Board) == common.White {
+		whiteTimeMs = min(left, whiteTimeMs)
+	} else {
+		blackTimeMs = min(left, blackTimeMs)
+	}
+	return whiteTimeMs, blackTimeMs
+}
+
+// flagDeadline returns the unix ms at which the side to move runs out of time
+func flagDeadline(cache *client.RedisCache) int64 {
+	remainingMs := cache.BlackTimeMs
+	if sideToMove(cache.Board) == common.White {
+		remainingMs = cache.WhiteTimeMs
+	}
+	allowanceMs := cache.TimeControl.AllowanceMs(remainingMs, moveNumber(cache.Board))
+	return cache.LastMoveAtMs + allowanceMs
+}
+
+// moveNumber reads the full move number from a FEN string. It is also the
+// number of the move the side to move is about to make.
+func moveNumber(fen string) int {
+	fields := strings.Fields(fen)
+	if len(fields) < 6 {
+		return 1
+	}
+	n, err := strconv.Atoi(fields[5])
+	if err != nil || n < 1 {
+		return 1
+	}
+	return n
+}
+
+// sideToMove reads the active color from a FEN string
+func sideToMove(fen string) common.PlayerColor {
+	fields := strings.Fields(fen)
+	if len(fields) > 1 && fields[1] == "b" {
+		return common.Black
+	}
+	return common.White
+}
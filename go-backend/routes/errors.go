@@ -0,0 +1,53 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/yashgadle/go-chess/common"
+	"github.com/yashgadle/go-chess/utils"
+)
+
+// actionError is a client action the server refused. It is reported back to
+// the sender and the connection stays open.
+type actionError struct {
+	Code    common.ErrorCode
+	Message string
+}
+
+func (e *actionError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func newActionError(code common.ErrorCode, format string, args ...any) *actionError {
+	return &actionError{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// sendError reports err to p. Errors that aren't actionErrors are logged and
+// surfaced as a generic internal error.
+func sendError(p *common.Player, requestId string, err error) {
+	reportError(p.Socket, p.Id, requestId, err)
+}
+
+// reportError reports err over s, for userId, who may be a player or a spectator
+func reportError(s *common.Socket, userId string, requestId string, err error) {
+	payload := common.ErrorPayload{
+		Code:      common.ErrInternal,
+		Message:   "something went wrong",
+		RequestId: requestId,
+	}
+
+	var actionErr *actionError
+	if errors.As(err, &actionErr) {
+		payload.Code = actionErr.Code
+		payload.Message = actionErr.Message
+	} else {
+		log.Printf("Error handling message from %s: %v", userId, err)
+	}
+
+	utils.WriteSignal(s, common.MsgError, payload)
+}
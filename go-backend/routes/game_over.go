@@ -0,0 +1,61 @@
+package routes
+
+import (
+	"context"
+	"time"
+
+	"github.com/corentings/chess/v2"
+	"github.com/yashgadle/go-chess/client"
+	"github.com/yashgadle/go-chess/common"
+	"github.com/yashgadle/go-chess/utils"
+)
+
+// setResult adds everything that ends the game with result to updates, and
+// stamps result with the time it ended. Pending offers and requests die with
+// the game, and so does its rating if the result doesn't count.
+func setResult(updates *client.UpdateOptions, result *common.GameResult) {
+	result.EndedAtMs = time.Now().UnixMilli()
+	gameEnd := true
+	if !result.Counts() {
+		rated := false
+		updates.Rated = &rated
+	}
+	updates.Board = &result.FEN
+	updates.PGN = &result.PGN
+	updates.WhiteTimeMs = &result.WhiteTimeMs
+	updates.BlackTimeMs = &result.BlackTimeMs
+	updates.GameEnd = &gameEnd
+	updates.Result = result
+	updates.DrawOffer = &client.DrawOffer{}
+	updates.Takeback = &client.TakebackRequest{}
+}
+
+// endGame stores result in one versioned write together with updates and
+// announces it to both players
+func endGame(ctx context.Context, gameId string, version int64, result common.GameResult) error {
+	updates := client.UpdateOptions{Version: &version}
+	setResult(&updates, &result)
+	if err := client.UpdateVal(ctx, gameId, updates, nil); err != nil {
+		return err
+	}
+	return announceGameOver(ctx, gameId, result)
+}
+
+// announceGameOver stops the clocks and sends the game_over event to both
+// players. Call it only after the result has been stored.
+func announceGameOver(ctx context.Context, gameId string, result common.GameResult) error {
+	flagTimers.Stop(gameId)
+	return publishEvent(ctx, gameId, "", common.MsgGameOver, result)
+}
+
+// abortedResult is the result of a game called off before both players
+// moved. It has no winner and no clock is charged.
+func abortedResult(game *chess.Game, cache *client.RedisCache) common.GameResult {
+	return common.GameResult{
+		Method:      common.Aborted,
+		FEN:         game.FEN(),
+		PGN:         utils.PGNWithResult(game, chess.NoOutcome, "aborted"),
+		WhiteTimeMs: cache.WhiteTimeMs,
+		BlackTimeMs: cache.BlackTimeMs,
+	}
+}
@@ -0,0 +1,412 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yashgadle/go-chess/client"
+	"github.com/yashgadle/go-chess/common"
+	"github.com/yashgadle/go-chess/utils"
+)
+
+// defaultRating is the rating every user plays at. Guests have no rating
+// history yet, so until ratings are kept everyone is seen at this one.
+const defaultRating = 1500
+
+// ratingOf returns the current rating of userId
+func ratingOf(userId string) int {
+	return defaultRating
+}
+
+// maxSeeksPerSocket bounds how many seeks one lobby connection may have open
+const maxSeeksPerSocket = 3
+
+// seekTTL is how long a seek lasts without being refreshed. Instances
+// refresh the seeks posted over their connections every seekTick, so only
+// seeks left behind by an instance that went away expire.
+const (
+	seekTTL  = 30 * time.Second
+	seekTick = 5 * time.Second
+)
+
+// openSeeks tracks the seeks posted over this instance's lobby connections
+// and keeps them from expiring while those connections last
+var openSeeks = &seekKeeper{ids: make(map[string]bool)}
+
+type seekKeeper struct {
+	mu    sync.Mutex
+	ids   map[string]bool
+	start sync.Once
+}
+
+func (k *seekKeeper) add(id string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.ids[id] = true
+	k.start.Do(func() { go k.run() })
+}
+
+func (k *seekKeeper) forget(id string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.ids, id)
+}
+
+// run refreshes the seeks every seekTick
+func (k *seekKeeper) run() {
+	ticker := time.NewTicker(seekTick)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		k.refresh(client.Ctx)
+	}
+}
+
+// refresh keeps this instance's seeks from expiring, and takes the expired
+// seeks of others off the lobby
+func (k *seekKeeper) refresh(ctx context.Context) {
+	k.mu.Lock()
+	ids := make([]string, 0, len(k.ids))
+	for id := range k.ids {
+		ids = append(ids, id)
+	}
+	k.mu.Unlock()
+
+	expired, err := client.RefreshSeeks(ctx, ids, time.Now().UnixMilli(), seekTTL)
+	if err != nil {
+		log.Printf("Failed to refresh seeks: %v", err)
+		return
+	}
+	for _, seek := range expired {
+		if err := publishEvent(ctx, common.LobbyFeed, "", common.MsgSeekRemoved, common.SeekIdPayload{Id: seek.Seek.Id}); err != nil {
+			log.Printf("Failed to remove expired seek %s: %v", seek.Seek.Id, err)
+		}
+	}
+}
+
+// seekExpired reports whether seek has gone unrefreshed for longer than
+// seekTTL at nowMs. Until the next refresh drops them, expired seeks are
+// passed over.
+func seekExpired(seek client.LobbySeek, nowMs int64) bool {
+	return seek.SeenAtMs < nowMs-seekTTL.Milliseconds()
+}
+
+// LobbyEndpoint streams the open seeks to anyone looking for a game. Members
+// post, cancel and accept seeks, or wait in a matchmaking queue; seeks and
+// queue places last only as long as the connection that made them. Accepting
+// a seek or being paired creates the game and sends both users to it.
+func LobbyEndpoint() http.HandlerFunc {
+	lobby := utils.GetLobby()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The lobby may be the first page a guest opens
+		userId := utils.SetGuestSession(w, r)
+		ws, err := upgrader.Upgrade(w, r, w.Header())
+		if err != nil {
+			log.Println("Failed to upgrade")
+			return
+		}
+
+		member := common.NewLobbyMember(userId, ws)
+		utils.StartWriter(member.Socket)
+		lobby.Join(member, func() { sendSeeks(r.Context(), member) })
+
+		session := &lobbySession{member: member, seeks: make(map[string]bool)}
+		readLobby(r.Context(), session)
+
+		member.Close()
+		lobby.Leave(member)
+		for id := range session.seeks {
+			if err := cancelSeek(client.Ctx, id); err != nil {
+				log.Printf("Failed to cancel seek %s: %v", id, err)
+			}
+		}
+		if err := matchmaker.leave(client.Ctx, session); err != nil {
+			log.Printf("Failed to leave the %s queue: %v", session.queued, err)
+		}
+	}
+}
+
+// lobbySession is what one lobby connection has open
+type lobbySession struct {
+	member *common.LobbyMember
+	// seeks holds the ids of the seeks posted over this connection
+	seeks map[string]bool
+	// queued is the time control of the queue joined, if any
+	queued string
+}
+
+// readLobby reads messages from s's member until the connection fails
+func readLobby(ctx context.Context, s *lobbySession) {
+	m := s.member
+	defer m.Close()
+	utils.WatchConnection(m.Socket)
+
+	for {
+		_, message, err := m.Conn.ReadMessage()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		var msg common.WSMessage
+		if err := json.Unmarshal(message, &msg); err != nil {
+			reportError(m.Socket, m.Id, "", newActionError(common.ErrBadMessage, "message is not valid JSON"))
+			continue
+		}
+
+		switch msg.Type {
+		case common.MsgSeek:
+			err = handleSeek(ctx, s, msg)
+		case common.MsgSeekCancel:
+			err = handleSeekCancel(ctx, s, msg)
+		case common.MsgSeekAccept:
+			err = handleSeekAccept(ctx, m, msg)
+		case common.MsgQueueJoin:
+			err = handleQueueJoin(ctx, s, msg)
+		case common.MsgQueueLeave:
+			err = handleQueueLeave(ctx, s)
+		default:
+			err = newActionError(common.ErrUnknownType, "unknown message type %q", msg.Type)
+		}
+		if err != nil {
+			reportError(m.Socket, m.Id, msg.RequestId, err)
+		}
+	}
+}
+
+// sendSeeks sends m every open seek
+func sendSeeks(ctx context.Context, m *common.LobbyMember) {
+	seeks, err := client.ListSeeks(ctx)
+	if err != nil {
+		log.Printf("Failed to list seeks: %v", err)
+		return
+	}
+	nowMs := time.Now().UnixMilli()
+	payload := common.SeeksPayload{Seeks: []common.Seek{}}
+	for _, s := range seeks {
+		if seekExpired(s, nowMs) {
+			continue
+		}
+		s.Seek.Mine = s.UserId == m.Id
+		payload.Seeks = append(payload.Seeks, s.Seek)
+	}
+	utils.WriteSignal(m.Socket, common.MsgSeeks, payload)
+}
+
+func handleSeek(ctx context.Context, s *lobbySession, msg common.WSMessage) error {
+	m := s.member
+	var seek common.Seek
+	if err := json.Unmarshal(msg.Data, &seek); err != nil {
+		return newActionError(common.ErrBadMessage, "invalid seek payload")
+	}
+	if err := s.pruneSeeks(ctx); err != nil {
+		return err
+	}
+	if len(s.seeks) >= maxSeeksPerSocket {
+		return newActionError(common.ErrInvalidSeek, "you already have %d open seeks", maxSeeksPerSocket)
+	}
+
+	if seek.TimeControl == "" {
+		seek.TimeControl = common.DefaultTimeControl.Spec
+	}
+	if _, err := common.ParseTimeControl(seek.TimeControl); err != nil {
+		return newActionError(common.ErrInvalidSeek, "%v", err)
+	}
+	if seek.Color != "" && seek.Color != common.White && seek.Color != common.Black {
+		return newActionError(common.ErrInvalidSeek, "invalid color %q", seek.Color)
+	}
+	if seek.RatingMin < 0 || seek.RatingMax < 0 || (seek.RatingMax != 0 && seek.RatingMin > seek.RatingMax) {
+		return newActionError(common.ErrInvalidSeek, "invalid rating range")
+	}
+
+	seek.Id = uuid.NewString()
+	seek.Rating = ratingOf(m.Id)
+	seek.CreatedAtMs = time.Now().UnixMilli()
+	seek.Mine = false
+	if err := client.AddSeek(ctx, client.LobbySeek{UserId: m.Id, Seek: seek, SeenAtMs: seek.CreatedAtMs}); err != nil {
+		return err
+	}
+	s.seeks[seek.Id] = true
+	openSeeks.add(seek.Id)
+	return publishEvent(ctx, common.LobbyFeed, m.Id, common.MsgSeek, seek)
+}
+
+// pruneSeeks forgets the seeks of s that have left the lobby without being
+// cancelled over s, e.g. because they were accepted or withdrawn when their
+// poster started a game
+func (s *lobbySession) pruneSeeks(ctx context.Context) error {
+	seeks, err := client.ListSeeks(ctx)
+	if err != nil {
+		return err
+	}
+	open := make(map[string]bool, len(seeks))
+	for _, seek := range seeks {
+		open[seek.Seek.Id] = true
+	}
+	for id := range s.seeks {
+		if !open[id] {
+			delete(s.seeks, id)
+			openSeeks.forget(id)
+		}
+	}
+	return nil
+}
+
+func handleSeekCancel(ctx context.Context, s *lobbySession, msg common.WSMessage) error {
+	var payload common.SeekIdPayload
+	if err := json.Unmarshal(msg.Data, &payload); err != nil {
+		return newActionError(common.ErrBadMessage, "invalid seek_cancel payload")
+	}
+	if !s.seeks[payload.Id] {
+		return newActionError(common.ErrInvalidSeek, "you have no such seek")
+	}
+	delete(s.seeks, payload.Id)
+	return cancelSeek(ctx, payload.Id)
+}
+
+// cancelSeek takes seek id off the lobby, unless it has already gone
+func cancelSeek(ctx context.Context, id string) error {
+	openSeeks.forget(id)
+	_, err := client.TakeSeek(ctx, id)
+	if errors.Is(err, client.ErrSeekNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return publishEvent(ctx, common.LobbyFeed, "", common.MsgSeekRemoved, common.SeekIdPayload{Id: id})
+}
+
+func handleSeekAccept(ctx context.Context, m *common.LobbyMember, msg common.WSMessage) error {
+	var payload common.SeekIdPayload
+	if err := json.Unmarshal(msg.Data, &payload); err != nil {
+		return newActionError(common.ErrBadMessage, "invalid seek_accept payload")
+	}
+
+	seeks, err := client.ListSeeks(ctx)
+	if err != nil {
+		return err
+	}
+	var seek *client.LobbySeek
+	for i := range seeks {
+		if seeks[i].Seek.Id == payload.Id && !seekExpired(seeks[i], time.Now().UnixMilli()) {
+			seek = &seeks[i]
+		}
+	}
+	if seek == nil {
+		return newActionError(common.ErrInvalidSeek, "the seek is no longer available")
+	}
+	if seek.UserId == m.Id {
+		return newActionError(common.ErrInvalidSeek, "you cannot accept your own seek")
+	}
+	rating := ratingOf(m.Id)
+	if (seek.Seek.RatingMin != 0 && rating < seek.Seek.RatingMin) || (seek.Seek.RatingMax != 0 && rating > seek.Seek.RatingMax) {
+		return newActionError(common.ErrInvalidSeek, "your rating is outside the seek's range")
+	}
+
+	// Of everyone accepting at once, only the one who takes the seek plays
+	seek, err = client.TakeSeek(ctx, payload.Id)
+	openSeeks.forget(payload.Id)
+	if errors.Is(err, client.ErrSeekNotFound) {
+		return newActionError(common.ErrInvalidSeek, "the seek is no longer available")
+	}
+	if err != nil {
+		return err
+	}
+	if err := publishEvent(ctx, common.LobbyFeed, "", common.MsgSeekRemoved, common.SeekIdPayload{Id: seek.Seek.Id}); err != nil {
+		return err
+	}
+
+	timeControl, err := common.ParseTimeControl(seek.Seek.TimeControl)
+	if err != nil {
+		return err
+	}
+	seekerColor := seek.Seek.Color
+	if seekerColor == "" {
+		seekerColor = randomColor()
+	}
+	opponentColor := common.White
+	if seekerColor == common.White {
+		opponentColor = common.Black
+	}
+	colors := map[string]common.PlayerColor{
+		seek.UserId: seekerColor,
+		m.Id:        opponentColor,
+	}
+	return startLobbyGame(ctx, timeControl, seek.Seek.Rated, colors)
+}
+
+// randomColor picks white or black with even odds
+func randomColor() common.PlayerColor {
+	if rand.IntN(2) == 0 {
+		return common.White
+	}
+	return common.Black
+}
+
+// startLobbyGame creates a game between two users who met in the lobby,
+// with both already seated, withdraws their other seeks, takes them out of
+// the matchmaking queues and sends both to the game. colors maps each user
+// to the color they play.
+func startLobbyGame(ctx context.Context, timeControl common.TimeControl, rated bool, colors map[string]common.PlayerColor) error {
+	gameId := uuid.NewString()
+
+	users := []client.User{}
+	for _, color := range []common.PlayerColor{common.White, common.Black} {
+		for userId, c := range colors {
+			if c == color {
+				users = append(users, client.User{Id: userId, Color: string(color)})
+			}
+		}
+	}
+	cache := newStartedGameCache(timeControl, users)
+	cache.Rated = rated
+
+	if err := storeNewGame(ctx, gameId, cache); err != nil {
+		return err
+	}
+	flagTimers.Arm(gameId, &cache)
+
+	if err := removeSeeksOf(ctx, colors); err != nil {
+		log.Printf("Failed to withdraw seeks of game %s's players: %v", gameId, err)
+	}
+	for userId := range colors {
+		if _, err := client.LeaveQueue(ctx, "", userId); err != nil {
+			log.Printf("Failed to take %s out of the queue for game %s: %v", userId, gameId, err)
+		}
+	}
+
+	gameFoundPayload := common.GameFoundPayload{
+		GameId: gameId,
+		Colors: colors,
+		Urls: map[common.PlayerColor]string{
+			common.White: joinGameUrl(gameId, string(common.White)),
+			common.Black: joinGameUrl(gameId, string(common.Black)),
+		},
+	}
+	return publishEvent(ctx, common.LobbyFeed, "", common.MsgGameFound, gameFoundPayload)
+}
+
+// removeSeeksOf withdraws every open seek posted by a user in users
+func removeSeeksOf(ctx context.Context, users map[string]common.PlayerColor) error {
+	seeks, err := client.ListSeeks(ctx)
+	if err != nil {
+		return err
+	}
+	for _, seek := range seeks {
+		if _, ok := users[seek.UserId]; ok {
+			if err := cancelSeek(ctx, seek.Seek.Id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/yashgadle/go-chess/client"
+	"github.com/yashgadle/go-chess/common"
+)
+
+var (
+	testServer *httptest.Server
+	testStore  *client.MemoryStore
+	testGM     *common.GameManager
+)
+
+// TestMain serves the routes the way main does, on the memory backend
+func TestMain(m *testing.M) {
+	testStore = client.NewMemoryStore()
+	client.SetBackend(testStore, testStore)
+
+	testGM = common.NewGameManager()
+	router := mux.NewRouter()
+	router.HandleFunc("/api/createGame", CreateGame).Methods("POST")
+	router.HandleFunc("/api/joinGame/{gameId}", JoinGame).Methods("GET")
+	router.HandleFunc("/api/game/{gameId}", GameSnapshot).Methods("GET")
+	router.HandleFunc("/ws/game/{gameId}", WSEndpoint(testGM))
+	router.HandleFunc("/ws/watch/{gameId}", WatchEndpoint(testGM))
+	router.HandleFunc("/ws/lobby", LobbyEndpoint())
+	testServer = httptest.NewServer(router)
+
+	code := m.Run()
+	testServer.Close()
+	os.Exit(code)
+}
+
+// testHTTP doesn't keep connections around, so they can't be mistaken for leaks
+var testHTTP = &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+// createTestGame creates a game with settings and returns its id
+func createTestGame(t *testing.T, settings GameType) string {
+	t.Helper()
+	body, err := json.Marshal(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := testHTTP.Post(testServer.URL+"/api/createGame", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("createGame: status %d", resp.StatusCode)
+	}
+
+	var created CreateGameResponse
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	gameId, _, _ := strings.Cut(strings.TrimPrefix(created.GameUrl, "/join-game/"), "?")
+	return gameId
+}
+
+// joinTestGame joins gameId as color with a new guest session and returns
+// the session cookie
+func joinTestGame(t *testing.T, gameId string, color common.PlayerColor) http.Header {
+	t.Helper()
+	resp, err := testHTTP.Get(testServer.URL + "/api/joinGame/" + gameId + "?color=" + string(color))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("joinGame as %s: status %d", color, resp.StatusCode)
+	}
+
+	header := http.Header{}
+	for _, cookie := range resp.Cookies() {
+		header.Add("Cookie", cookie.Name+"="+cookie.Value)
+	}
+	return header
+}
+
+// testConn is a client websocket whose messages are read in the background
+type testConn struct {
+	ws       *websocket.Conn
+	messages chan common.WSMessage
+	// err is why reading stopped, set once messages is closed
+	err error
+}
+
+// dialTest opens a websocket to path with header, from our own origin
+func dialTest(t *testing.T, path string, header http.Header) *testConn {
+	t.Helper()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Origin", "https://"+strings.TrimPrefix(testServer.URL, "http://"))
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(testServer.URL, "http")+path, header)
+	if err != nil {
+		t.Fatalf("dial %s: %v", path, err)
+	}
+	c := &testConn{ws: ws, messages: make(chan common.WSMessage, 64)}
+	go func() {
+		defer close(c.messages)
+		for {
+			var msg common.WSMessage
+			if err := ws.ReadJSON(&msg); err != nil {
+				c.err = err
+				return
+			}
+			c.messages <- msg
+		}
+	}()
+	return c
+}
+
+func (c *testConn) send(t *testing.T, msgType common.MessageType, payload any) {
+	t.Helper()
+	msg := common.WSMessage{Type: msgType}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.Data = data
+	}
+	if err := c.ws.WriteJSON(msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expect skips messages until one of msgType arrives, and returns it
+func (c *testConn) expect(t *testing.T, msgType common.MessageType) common.WSMessage {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg, ok := <-c.messages:
+			if !ok {
+				t.Fatalf("connection closed waiting for %s", msgType)
+			}
+			if msg.Type == common.MsgError {
+				t.Fatalf("error waiting for %s: %s", msgType, msg.Data)
+			}
+			if msg.Type == msgType {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s", msgType)
+		}
+	}
+}
+
+// expectError skips messages until an error arrives, and fails unless it
+// carries code
+func (c *testConn) expectError(t *testing.T, code common.ErrorCode) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg, ok := <-c.messages:
+			if !ok {
+				t.Fatalf("connection closed waiting for a %s error", code)
+			}
+			if msg.Type != common.MsgError {
+				continue
+			}
+			var payload common.ErrorPayload
+			if err := json.Unmarshal(msg.Data, &payload); err != nil {
+				t.Fatal(err)
+			}
+			if payload.Code != code {
+				t.Fatalf("got a %s error (%s), want %s", payload.Code, payload.Message, code)
+			}
+			return
+		case <-timeout:
+			t.Fatalf("timed out waiting for a %s error", code)
+		}
+	}
+}
+
+// expectRejected waits for the server to close the connection as a policy
+// violation, failing on any game_state or move sent before that
+func (c *testConn) expectRejected(t *testing.T) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg, ok := <-c.messages:
+			if !ok {
+				if !websocket.IsCloseError(c.err, websocket.ClosePolicyViolation) {
+					t.Fatalf("connection ended with %v, want a policy violation", c.err)
+				}
+				return
+			}
+			if msg.Type == common.MsgGameState || msg.Type == common.MsgMove {
+				t.Fatalf("rejected connection was sent %s: %s", msg.Type, msg.Data)
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting to be rejected")
+		}
+	}
+}
+
+// close closes the connection and waits for its reader to stop
+func (c *testConn) close() {
+	c.ws.Close()
+	for range c.messages {
+	}
+}
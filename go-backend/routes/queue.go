@@ -0,0 +1,269 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/yashgadle/go-chess/client"
+	"github.com/yashgadle/go-chess/common"
+	"github.com/yashgadle/go-chess/utils"
+)
+
+// queueTick is how often the queues with users waiting on this instance are
+// matched again, so the rating windows can widen
+const queueTick = time.Second
+
+// queueEntryTTL is how long a queue entry lasts without being refreshed.
+// Instances refresh their users' entries every queueTick, so only entries
+// left behind by an instance that went away expire.
+const queueEntryTTL = 10 * time.Second
+
+// Two waiting users are paired once their ratings are within both of their
+// windows. A window starts at queueRatingWindow and grows by
+// queueWindowGrowth for every queueWindowStep waited.
+const (
+	queueRatingWindow = 100
+	queueWindowGrowth = 50
+	queueWindowStep   = 5 * time.Second
+)
+
+// matchmaker pairs users waiting in the shared matchmaking queues. Each
+// instance matches the queues its own lobby members wait in; taking a pair
+// out of a queue is atomic, so instances matching the same queue can't
+// pair anyone twice.
+var matchmaker = &matchQueue{
+	waiting: make(map[string]map[*lobbySession]int64),
+}
+
+type matchQueue struct {
+	mu sync.Mutex
+	// waiting holds the sessions on this instance in each queue, by time
+	// control, with when each was stored in the queue
+	waiting map[string]map[*lobbySession]int64
+	start   sync.Once
+}
+
+func handleQueueJoin(ctx context.Context, s *lobbySession, msg common.WSMessage) error {
+	var payload common.QueuePayload
+	if err := json.Unmarshal(msg.Data, &payload); err != nil {
+		return newActionError(common.ErrBadMessage, "invalid queue_join payload")
+	}
+	tc, err := common.ParseTimeControl(payload.TimeControl)
+	if err != nil {
+		return newActionError(common.ErrInvalidQueue, "%v", err)
+	}
+	// Specs meaning the same time control share a queue
+	payload.TimeControl = tc.Canonical()
+
+	// A connection waits in one queue at a time
+	if err := matchmaker.leave(ctx, s); err != nil {
+		return err
+	}
+	if err := matchmaker.join(ctx, s, payload.TimeControl); err != nil {
+		return err
+	}
+	utils.WriteSignal(s.member.Socket, common.MsgQueueJoin, payload)
+
+	matchmaker.match(ctx, payload.TimeControl)
+	return nil
+}
+
+func handleQueueLeave(ctx context.Context, s *lobbySession) error {
+	if s.queued == "" {
+		return newActionError(common.ErrInvalidQueue, "you are not in a queue")
+	}
+	payload := common.QueuePayload{TimeControl: s.queued}
+	if err := matchmaker.leave(ctx, s); err != nil {
+		return err
+	}
+	utils.WriteSignal(s.member.Socket, common.MsgQueueLeave, payload)
+	return nil
+}
+
+// join puts s's user in the queue for timeControl, a canonical spec, and
+// makes sure this instance keeps matching and refreshing it
+func (q *matchQueue) join(ctx context.Context, s *lobbySession, timeControl string) error {
+	nowMs := time.Now().UnixMilli()
+	entry := client.QueueEntry{
+		UserId:      s.member.Id,
+		TimeControl: timeControl,
+		Rating:      ratingOf(s.member.Id),
+		JoinedAtMs:  nowMs,
+		SeenAtMs:    nowMs,
+	}
+	if err := client.JoinQueue(ctx, entry); err != nil {
+		return err
+	}
+	s.queued = timeControl
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.waiting[timeControl] == nil {
+		q.waiting[timeControl] = make(map[*lobbySession]int64)
+	}
+	q.waiting[timeControl][s] = time.Now().UnixMilli()
+	q.start.Do(func() { go q.run() })
+	return nil
+}
+
+// leave takes s's user out of their queue, if they are still in it
+func (q *matchQueue) leave(ctx context.Context, s *lobbySession) error {
+	if s.queued == "" {
+		return nil
+	}
+	timeControl := s.queued
+	s.queued = ""
+
+	q.mu.Lock()
+	delete(q.waiting[timeControl], s)
+	if len(q.waiting[timeControl]) == 0 {
+		delete(q.waiting, timeControl)
+	}
+	q.mu.Unlock()
+
+	_, err := client.LeaveQueue(ctx, timeControl, s.member.Id)
+	return err
+}
+
+// run refreshes and matches every queue with users waiting on this
+// instance, every queueTick
+func (q *matchQueue) run() {
+	ticker := time.NewTicker(queueTick)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		q.mu.Lock()
+		timeControls := make([]string, 0, len(q.waiting))
+		for timeControl := range q.waiting {
+			timeControls = append(timeControls, timeControl)
+		}
+		q.mu.Unlock()
+
+		for _, timeControl := range timeControls {
+			q.refresh(client.Ctx, timeControl)
+			q.match(client.Ctx, timeControl)
+		}
+	}
+}
+
+// refresh keeps the entries of the users waiting for timeControl on this
+// instance from expiring, and drops the expired entries of others
+func (q *matchQueue) refresh(ctx context.Context, timeControl string) {
+	q.mu.Lock()
+	userIds := make([]string, 0, len(q.waiting[timeControl]))
+	for s := range q.waiting[timeControl] {
+		userIds = append(userIds, s.member.Id)
+	}
+	q.mu.Unlock()
+
+	if err := client.RefreshQueue(ctx, timeControl, userIds, time.Now().UnixMilli(), queueEntryTTL); err != nil {
+		log.Printf("Failed to refresh the %s queue: %v", timeControl, err)
+	}
+}
+
+// match pairs the users waiting for timeControl, longest waiting first, each
+// with the closest rated user whose window allows it. Sessions on this
+// instance whose user is no longer waiting stop being matched.
+func (q *matchQueue) match(ctx context.Context, timeControl string) {
+	listedAtMs := time.Now().UnixMilli()
+	entries, err := client.ListQueue(ctx, timeControl)
+	if err != nil {
+		log.Printf("Failed to read the %s queue: %v", timeControl, err)
+		return
+	}
+	tc, err := common.ParseTimeControl(timeControl)
+	if err != nil {
+		log.Printf("Invalid queue time control %q: %v", timeControl, err)
+		return
+	}
+
+	gone := make(map[string]bool)
+	for _, entry := range entries {
+		// Until the next refresh drops them, expired entries are passed over
+		if entry.SeenAtMs < listedAtMs-queueEntryTTL.Milliseconds() {
+			gone[entry.UserId] = true
+		}
+	}
+	for i, a := range entries {
+		if gone[a.UserId] {
+			continue
+		}
+		best := -1
+		for j := i + 1; j < len(entries); j++ {
+			b := entries[j]
+			diff := abs(a.Rating - b.Rating)
+			if gone[b.UserId] || diff > ratingWindow(a, listedAtMs) || diff > ratingWindow(b, listedAtMs) {
+				continue
+			}
+			if best < 0 || diff < abs(a.Rating-entries[best].Rating) {
+				best = j
+			}
+		}
+		if best < 0 {
+			continue
+		}
+		b := entries[best]
+
+		taken, err := client.TakeQueuedPair(ctx, timeControl, a.UserId, b.UserId)
+		if err != nil {
+			log.Printf("Failed to pair from the %s queue: %v", timeControl, err)
+			return
+		}
+		if !taken {
+			// Someone else paired or left first; the next round sees it
+			continue
+		}
+		gone[a.UserId], gone[b.UserId] = true, true
+
+		colorA := randomColor()
+		colorB := common.White
+		if colorA == common.White {
+			colorB = common.Black
+		}
+		colors := map[string]common.PlayerColor{a.UserId: colorA, b.UserId: colorB}
+		if err := startLobbyGame(ctx, tc, false, colors); err != nil {
+			log.Printf("Failed to start a %s game from the queue: %v", timeControl, err)
+			// Neither user has a game, so both go back to where they were
+			for _, entry := range []client.QueueEntry{a, b} {
+				entry.SeenAtMs = time.Now().UnixMilli()
+				if err := client.JoinQueue(ctx, entry); err != nil {
+					log.Printf("Failed to requeue %s in the %s queue: %v", entry.UserId, timeControl, err)
+					continue
+				}
+				gone[entry.UserId] = false
+			}
+		}
+	}
+
+	waiting := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		waiting[entry.UserId] = !gone[entry.UserId]
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for s, storedAtMs := range q.waiting[timeControl] {
+		// Sessions that joined after the queue was read aren't in entries yet
+		if storedAtMs < listedAtMs && !waiting[s.member.Id] {
+			delete(q.waiting[timeControl], s)
+		}
+	}
+	if len(q.waiting[timeControl]) == 0 {
+		delete(q.waiting, timeControl)
+	}
+}
+
+// ratingWindow is how far from entry's rating an opponent may be at nowMs
+func ratingWindow(entry client.QueueEntry, nowMs int64) int {
+	waited := time.Duration(nowMs-entry.JoinedAtMs) * time.Millisecond
+	return queueRatingWindow + queueWindowGrowth*int(waited/queueWindowStep)
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,163 @@
+package routes
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/yashgadle/go-chess/client"
+	"github.com/yashgadle/go-chess/common"
+)
+
+func TestQueueSpecsShareAQueue(t *testing.T) {
+	a := dialTest(t, "/ws/lobby", nil)
+	defer a.close()
+	b := dialTest(t, "/ws/lobby", nil)
+	defer b.close()
+
+	a.send(t, common.MsgQueueJoin, common.QueuePayload{TimeControl: "5|2"})
+	var joined common.QueuePayload
+	if err := json.Unmarshal(a.expect(t, common.MsgQueueJoin).Data, &joined); err != nil {
+		t.Fatal(err)
+	}
+	if joined.TimeControl != "5+2" {
+		t.Errorf("queue_join confirmed %q, want the canonical %q", joined.TimeControl, "5+2")
+	}
+	b.send(t, common.MsgQueueJoin, common.QueuePayload{TimeControl: " 5+2"})
+
+	a.expect(t, common.MsgGameFound)
+	b.expect(t, common.MsgGameFound)
+}
+
+func TestQueueDropsExpiredEntries(t *testing.T) {
+	// An entry left behind by an instance that went away
+	stale := client.QueueEntry{
+		UserId:      "gone",
+		TimeControl: "7+0",
+		Rating:      defaultRating,
+		JoinedAtMs:  time.Now().Add(-time.Minute).UnixMilli(),
+		SeenAtMs:    time.Now().Add(-time.Minute).UnixMilli(),
+	}
+	if err := client.JoinQueue(client.Ctx, stale); err != nil {
+		t.Fatal(err)
+	}
+
+	c := dialTest(t, "/ws/lobby", nil)
+	defer c.close()
+	c.send(t, common.MsgQueueJoin, common.QueuePayload{TimeControl: "7|0"})
+	c.expect(t, common.MsgQueueJoin)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		entries, err := client.ListQueue(client.Ctx, "7+0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) == 1 && entries[0].UserId != stale.UserId {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("7+0 queue holds %+v, want only the connected user", entries)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestSeekAcceptLeavesQueue(t *testing.T) {
+	accepter := dialTest(t, "/ws/lobby", nil)
+	defer accepter.close()
+	accepter.expect(t, common.MsgSeeks)
+	seeker := dialTest(t, "/ws/lobby", nil)
+	defer seeker.close()
+
+	seeker.send(t, common.MsgQueueJoin, common.QueuePayload{TimeControl: "15|10"})
+	seeker.expect(t, common.MsgQueueJoin)
+	seeker.send(t, common.MsgSeek, common.Seek{TimeControl: "3|1"})
+
+	var seek common.Seek
+	if err := json.Unmarshal(accepter.expect(t, common.MsgSeek).Data, &seek); err != nil {
+		t.Fatal(err)
+	}
+	accepter.send(t, common.MsgSeekAccept, common.SeekIdPayload{Id: seek.Id})
+	seeker.expect(t, common.MsgGameFound)
+	accepter.expect(t, common.MsgGameFound)
+
+	entries, err := client.ListQueue(client.Ctx, "15+10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("15+10 queue holds %+v after its user's seek was accepted", entries)
+	}
+}
+
+func TestTakenSeeksFreeTheirSlots(t *testing.T) {
+	accepter := dialTest(t, "/ws/lobby", nil)
+	defer accepter.close()
+	accepter.expect(t, common.MsgSeeks)
+	seeker := dialTest(t, "/ws/lobby", nil)
+	defer seeker.close()
+
+	var first common.Seek
+	for i := range maxSeeksPerSocket {
+		seeker.send(t, common.MsgSeek, common.Seek{TimeControl: "3|2"})
+		seeker.expect(t, common.MsgSeek)
+		seek := accepter.expect(t, common.MsgSeek)
+		if i == 0 {
+			if err := json.Unmarshal(seek.Data, &first); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Accepting one withdraws the rest, so every slot is free again
+	accepter.send(t, common.MsgSeekAccept, common.SeekIdPayload{Id: first.Id})
+	seeker.expect(t, common.MsgGameFound)
+	for range maxSeeksPerSocket {
+		seeker.send(t, common.MsgSeek, common.Seek{TimeControl: "3|2"})
+		seeker.expect(t, common.MsgSeek)
+	}
+}
+
+func TestRefreshDropsExpiredSeeks(t *testing.T) {
+	// A seek left behind by an instance that went away
+	stale := client.LobbySeek{
+		UserId:   "gone",
+		Seek:     common.Seek{Id: "stale-seek", TimeControl: "5|0"},
+		SeenAtMs: time.Now().Add(-time.Hour).UnixMilli(),
+	}
+	if err := client.AddSeek(client.Ctx, stale); err != nil {
+		t.Fatal(err)
+	}
+
+	c := dialTest(t, "/ws/lobby", nil)
+	defer c.close()
+	var listed common.SeeksPayload
+	if err := json.Unmarshal(c.expect(t, common.MsgSeeks).Data, &listed); err != nil {
+		t.Fatal(err)
+	}
+	for _, seek := range listed.Seeks {
+		if seek.Id == stale.Seek.Id {
+			t.Fatal("expired seek was listed")
+		}
+	}
+	c.send(t, common.MsgSeek, common.Seek{TimeControl: "5|0"})
+	c.expect(t, common.MsgSeek)
+
+	openSeeks.refresh(client.Ctx)
+	var removed common.SeekIdPayload
+	if err := json.Unmarshal(c.expect(t, common.MsgSeekRemoved).Data, &removed); err != nil {
+		t.Fatal(err)
+	}
+	if removed.Id != stale.Seek.Id {
+		t.Fatalf("removed seek %s, want %s", removed.Id, stale.Seek.Id)
+	}
+
+	seeks, err := client.ListSeeks(client.Ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seeks) != 1 || seeks[0].UserId == stale.UserId {
+		t.Fatalf("seeks are %+v, want only the connected user's", seeks)
+	}
+}
@@ -0,0 +1,109 @@
+package routes
+
+import (
+	"log"
+
+	"github.com/google/uuid"
+	"github.com/yashgadle/go-chess/client"
+	"github.com/yashgadle/go-chess/common"
+)
+
+// requireRematchable rejects rematch messages from anyone who didn't play in
+// the game, while the game is still going, or once a rematch exists
+func (a *action) requireRematchable() error {
+	if a.user.Id == "" || (a.user.Color != string(common.White) && a.user.Color != string(common.Black)) {
+		return newActionError(common.ErrNotPlayer, "you are not playing in this game")
+	}
+	if !a.cache.GameEnd {
+		return newActionError(common.ErrInvalidRematch, "the game is not over yet")
+	}
+	if a.cache.RematchId != "" {
+		return newActionError(common.ErrInvalidRematch, "a rematch has already been arranged")
+	}
+	return nil
+}
+
+func handleRematchOffer(a *action) error {
+	if err := a.requireRematchable(); err != nil {
+		return err
+	}
+
+	switch a.cache.RematchOffer {
+	case a.user.Color:
+		return newActionError(common.ErrInvalidRematch, "you already offered a rematch")
+	case a.opponentColor():
+		// Both want a rematch, so offering back is the same as accepting
+		return startRematch(a)
+	}
+
+	err := client.UpdateVal(a.ctx, a.gameId, client.UpdateOptions{
+		RematchOffer: &a.user.Color,
+		Version:      &a.cache.Version,
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	rematchOfferPayload := common.RematchOfferPayload{
+		By: common.PlayerColor(a.user.Color),
+	}
+	return publishEvent(a.ctx, a.gameId, a.p.Id, common.MsgRematchOffer, rematchOfferPayload)
+}
+
+func handleRematchAccept(a *action) error {
+	if err := a.requireRematchable(); err != nil {
+		return err
+	}
+	if a.cache.RematchOffer != a.opponentColor() {
+		return newActionError(common.ErrInvalidRematch, "there is no rematch offer from your opponent")
+	}
+	return startRematch(a)
+}
+
+// startRematch creates the follow-up game with colors swapped and the same
+// time control, links the two games and sends both players to the new one
+func startRematch(a *action) error {
+	rematchId := uuid.NewString()
+
+	users := []client.User{}
+	for _, u := range a.cache.Users {
+		color := string(common.White)
+		if u.Color == string(common.White) {
+			color = string(common.Black)
+		}
+		users = append(users, client.User{Id: u.Id, Color: color})
+	}
+	cache := newStartedGameCache(a.cache.TimeControl, users)
+	cache.SpectatorDelay = a.cache.SpectatorDelay
+	cache.RematchOf = a.gameId
+
+	if err := storeNewGame(a.ctx, rematchId, cache); err != nil {
+		return err
+	}
+
+	// Only then link it from the finished game. Of two accepts racing on
+	// different instances, the one whose link is written keeps its game.
+	noOffer := ""
+	err := client.UpdateVal(a.ctx, a.gameId, client.UpdateOptions{
+		RematchOffer: &noOffer,
+		RematchId:    &rematchId,
+		Version:      &a.cache.Version,
+	}, nil)
+	if err != nil {
+		if delErr := client.DeleteGame(a.ctx, rematchId); delErr != nil {
+			log.Printf("Failed to delete unlinked rematch %s: %v", rematchId, delErr)
+		}
+		return err
+	}
+	flagTimers.Arm(rematchId, &cache)
+
+	rematchPayload := common.RematchPayload{
+		GameId:    rematchId,
+		RematchOf: a.gameId,
+		Urls: map[common.PlayerColor]string{
+			common.White: joinGameUrl(rematchId, string(common.White)),
+			common.Black: joinGameUrl(rematchId, string(common.Black)),
+		},
+	}
+	return publishEvent(a.ctx, a.gameId, "", common.MsgRematch, rematchPayload)
+}
@@ -0,0 +1,54 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/yashgadle/go-chess/client"
+	"github.com/yashgadle/go-chess/common"
+	"github.com/yashgadle/go-chess/utils"
+)
+
+// handleAck records how far p's client has got through the game's events
+func handleAck(p *common.Player, msg common.WSMessage) error {
+	if err := requireSeated(p); err != nil {
+		return err
+	}
+
+	var ack common.AckPayload
+	if err := json.Unmarshal(msg.Data, &ack); err != nil {
+		return newActionError(common.ErrBadMessage, "invalid ack payload")
+	}
+
+	// Acks can arrive out of order; only ever move forward
+	for {
+		acked := p.AckedSeq.Load()
+		if ack.Seq <= acked || p.AckedSeq.CompareAndSwap(acked, ack.Seq) {
+			return nil
+		}
+	}
+}
+
+// handleResumeFrom replays the events p's client missed. If they are no
+// longer kept it sends a full snapshot instead.
+func handleResumeFrom(ctx context.Context, p *common.Player, gameId string, msg common.WSMessage) error {
+	// The log holds everything as it happened, offers and chat included
+	if err := requireSeated(p); err != nil {
+		return err
+	}
+
+	resume := common.ResumeFromPayload{Seq: p.AckedSeq.Load()}
+	if len(msg.Data) > 0 {
+		if err := json.Unmarshal(msg.Data, &resume); err != nil {
+			return newActionError(common.ErrBadMessage, "invalid resume_from payload")
+		}
+	}
+
+	err := utils.ReplayEvents(ctx, p, gameId, resume.Seq)
+	if errors.Is(err, client.ErrEventsExpired) {
+		sendGameState(ctx, p, gameId)
+		return nil
+	}
+	return err
+}
@@ -2,6 +2,7 @@
 package routes
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -12,12 +13,16 @@ import (
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/yashgadle/go-chess/client"
+	"github.com/yashgadle/go-chess/common"
 	"github.com/yashgadle/go-chess/utils"
 )
 
 type GameType struct {
 	Color string `json:"color"`
 	Time  string `json:"time"`
+	// Spectators may be held back by seconds or by plies, but not both
+	SpectatorDelaySeconds int `json:"spectatorDelaySeconds,omitempty"`
+	SpectatorDelayPlies   int `json:"spectatorDelayPlies,omitempty"`
 }
 
 type CreateGameResponse struct {
@@ -40,23 +45,24 @@ func CreateGame(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	chess := chess.NewGame()
-	chess.AddTagPair("Event", "Random Online Chess Game")
-
-	timeControl := gameSettings.Time
-	timeMs := utils.GetTime(utils.TimeControl(timeControl))
-
-	exp := 24 * time.Hour
-	cache := client.RedisCache{
-		Users:        []client.User{},
-		Board:        chess.FEN(),
-		WhiteTimeMs:  timeMs,
-		BlackTimeMs:  timeMs,
-		LastMoveAtMs: 0,
-		PGN:          chess.String(),
+	timeControl := common.DefaultTimeControl
+	if gameSettings.Time != "" {
+		timeControl, err = common.ParseTimeControl(gameSettings.Time)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 	}
-	err = client.CreateGame(r.Context(), gameId, cache, &exp)
+
+	spectatorDelay, err := common.NewSpectatorDelay(gameSettings.SpectatorDelaySeconds, gameSettings.SpectatorDelayPlies)
 	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cache := newGameCache(timeControl)
+	cache.SpectatorDelay = spectatorDelay
+	if err = storeNewGame(r.Context(), gameId, cache); err != nil {
 		http.Error(w, "Error Writing to Redis", http.StatusInternalServerError)
 		return
 	}
@@ -65,8 +71,8 @@ func CreateGame(w http.ResponseWriter, r *http.Request) {
 	if opponentColor == "" {
 		opponentColor = "b"
 	}
-	startGameUrl := fmt.Sprintf("/join-game/%s?color=%s", gameId, gameSettings.Color)
-	inviteUrl := fmt.Sprintf("/join-game/%s?color=%s", gameId, opponentColor)
+	startGameUrl := joinGameUrl(gameId, gameSettings.Color)
+	inviteUrl := joinGameUrl(gameId, opponentColor)
 
 	w.Header().Set("content-type", "application/json")
 	json.NewEncoder(w).Encode(CreateGameResponse{
@@ -75,6 +81,52 @@ func CreateGame(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// gameExpiry is how long a game is kept after it is created
+const gameExpiry = 24 * time.Hour
+
+// newGameCache returns the stored state of a game that hasn't started yet
+func newGameCache(timeControl common.TimeControl) client.RedisCache {
+	game := chess.NewGame()
+	game.AddTagPair("Event", "Random Online Chess Game")
+
+	timeMs := timeControl.InitialMs()
+	return client.RedisCache{
+		Users:        []client.User{},
+		Board:        game.FEN(),
+		WhiteTimeMs:  timeMs,
+		BlackTimeMs:  timeMs,
+		LastMoveAtMs: 0,
+		PGN:          game.String(),
+		TimeControl:  timeControl,
+	}
+}
+
+// newStartedGameCache is a new game with users already seated, as when a
+// lobby pairing or a rematch creates it. Unlike a game waiting for its
+// second player, it starts right away, so white's first move is due within
+// the abort window from now.
+func newStartedGameCache(timeControl common.TimeControl, users []client.User) client.RedisCache {
+	cache := newGameCache(timeControl)
+	cache.Users = users
+	cache.StartedAtMs = time.Now().UnixMilli()
+	return cache
+}
+
+// storeNewGame saves cache as a new game under gameId
+func storeNewGame(ctx context.Context, gameId string, cache client.RedisCache) error {
+	exp := gameExpiry
+	return client.CreateGame(ctx, gameId, cache, &exp)
+}
+
+// joinGameUrl is the page a player opens to play gameId as color
+func joinGameUrl(gameId string, color string) string {
+	return fmt.Sprintf("/join-game/%s?color=%s", gameId, color)
+}
+
+// joinRetries bounds how often JoinGame re-reads the game after losing a
+// race with another write, e.g. the opponent joining at the same moment
+const joinRetries = 5
+
 func JoinGame(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	gameId := vars["gameId"]
@@ -83,58 +135,95 @@ func JoinGame(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Game not found", http.StatusNotFound)
 		return
 	}
-	gameCache, err := client.GetVal(r.Context(), gameId)
-	if err != nil {
-		http.Error(w, "Error Reading from Redis", http.StatusInternalServerError)
-		return
-	}
-
 	color := r.URL.Query().Get("color")
-	currentUsersInGame := gameCache.Users
-
-	if len(currentUsersInGame) == 2 {
-		http.Error(w, "2 players already joined", http.StatusForbidden)
-		return
-	}
 
 	userId, err := utils.GetGuestSession(r)
 	if err != nil || userId == "" {
 		userId = utils.SetGuestSession(w, r)
 	}
 
-	push := true
-	for _, u := range currentUsersInGame {
-		if u.Id == userId {
-			push = false
+	for range joinRetries {
+		gameCache, err := client.GetVal(r.Context(), gameId)
+		if err != nil {
+			http.Error(w, "Error Reading from Redis", http.StatusInternalServerError)
+			return
+		}
+		currentUsersInGame := gameCache.Users
+
+		push := true
+		for _, u := range currentUsersInGame {
+			if u.Id == userId {
+				push = false
+			}
+		}
+
+		// Players already in the game, e.g. of a rematch, just rejoin
+		if push && len(currentUsersInGame) == 2 {
+			http.Error(w, "2 players already joined", http.StatusForbidden)
+			return
+		}
+		if !push {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		if color != string(common.White) && color != string(common.Black) {
+			http.Error(w, "Invalid color", http.StatusBadRequest)
+			return
+		}
+		for _, u := range currentUsersInGame {
+			if u.Color == color {
+				http.Error(w, "Color already taken", http.StatusForbidden)
+				return
+			}
 		}
-	}
 
-	if push || len(currentUsersInGame) == 0 {
 		currentUsersInGame = append(currentUsersInGame, client.User{
 			Id:    userId,
 			Color: color,
 		})
 
-		err := client.UpdateVal(r.Context(), gameId, client.UpdateOptions{
-			Users:        &currentUsersInGame,
-		}, nil)
+		updates := client.UpdateOptions{
+			Users:   &currentUsersInGame,
+			Version: &gameCache.Version,
+		}
+		// The game starts once both players are in; white's first move is
+		// due within the abort window from here
+		startedAtMs := time.Now().UnixMilli()
+		if len(currentUsersInGame) == 2 {
+			updates.StartedAtMs = &startedAtMs
+		}
+
+		err = client.UpdateVal(r.Context(), gameId, updates, nil)
+		if isConflict(err) {
+			// Someone else joined or the game moved on; merge into what is there now
+			continue
+		}
 		if err != nil {
 			http.Error(w, "Error Writing to Redis", http.StatusInternalServerError)
 			return
 		}
+
+		if updates.StartedAtMs != nil {
+			gameCache.Users = currentUsersInGame
+			gameCache.StartedAtMs = startedAtMs
+			flagTimers.Arm(gameId, gameCache)
+		}
+		w.WriteHeader(http.StatusOK)
+		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	http.Error(w, "Game changed while joining, please retry", http.StatusConflict)
 }
 
 func HealthCheck(w http.ResponseWriter, r *http.Request) {
-	_, err := client.Redis()
+	err := client.Ping(r.Context())
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusServiceUnavailable)
 		json.NewEncoder(w).Encode(map[string]string{
 			"status": "unhealthy",
-			"error":  "Redis connection failed",
+			"error":  "Game store connection failed",
 		})
 		return
 	}
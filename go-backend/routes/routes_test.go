@@ -0,0 +1,213 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yashgadle/go-chess/client"
+	"github.com/yashgadle/go-chess/common"
+)
+
+func TestGamePlaysToCheckmate(t *testing.T) {
+	gameId := createTestGame(t, GameType{Color: "w", Time: common.Time5_2})
+	white := dialTest(t, "/ws/game/"+gameId, joinTestGame(t, gameId, common.White))
+	defer white.close()
+	black := dialTest(t, "/ws/game/"+gameId, joinTestGame(t, gameId, common.Black))
+	defer black.close()
+	white.expect(t, common.MsgGameState)
+	black.expect(t, common.MsgGameState)
+
+	// Fool's mate
+	moves := []struct {
+		mover, opponent *testConn
+		from, to        string
+	}{
+		{white, black, "f2", "f3"},
+		{black, white, "e7", "e5"},
+		{white, black, "g2", "g4"},
+		{black, white, "d8", "h4"},
+	}
+	for _, m := range moves {
+		m.mover.send(t, common.MsgMove, common.MovePayload{FromSquare: m.from, ToSquare: m.to})
+		m.mover.expect(t, common.MsgAck)
+		m.opponent.expect(t, common.MsgMove)
+	}
+
+	for _, c := range []*testConn{white, black} {
+		var result common.GameResult
+		if err := json.Unmarshal(c.expect(t, common.MsgGameOver).Data, &result); err != nil {
+			t.Fatal(err)
+		}
+		if result.Winner != common.Black || result.Method != common.Checkmate {
+			t.Errorf("game over: winner %q by %q, want %q by %q", result.Winner, result.Method, common.Black, common.Checkmate)
+		}
+	}
+
+	resp, err := testHTTP.Get(testServer.URL + "/api/game/" + gameId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("snapshot of the finished game: status %d", resp.StatusCode)
+	}
+}
+
+func TestAbortedGameRecord(t *testing.T) {
+	gameId := createTestGame(t, GameType{Color: "w", Time: common.Time5_2})
+	white := dialTest(t, "/ws/game/"+gameId, joinTestGame(t, gameId, common.White))
+	defer white.close()
+	black := dialTest(t, "/ws/game/"+gameId, joinTestGame(t, gameId, common.Black))
+	defer black.close()
+	white.expect(t, common.MsgGameState)
+	black.expect(t, common.MsgGameState)
+	rated := true
+	if err := client.UpdateVal(client.Ctx, gameId, client.UpdateOptions{Rated: &rated}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	white.send(t, common.MsgAbort, nil)
+	var result common.GameResult
+	if err := json.Unmarshal(black.expect(t, common.MsgGameOver).Data, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Method != common.Aborted || !strings.Contains(result.PGN, `[Termination "aborted"]`) {
+		t.Errorf("aborted game ended by %q with record:\n%s", result.Method, result.PGN)
+	}
+
+	// Aborted games don't count towards ratings
+	cache, err := client.GetVal(client.Ctx, gameId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache.Rated {
+		t.Error("aborted game is still rated")
+	}
+}
+
+// racingStore runs race once, just before the next game update, the way a
+// write from another request or instance could land first
+type racingStore struct {
+	*client.MemoryStore
+	race func()
+}
+
+func (s *racingStore) UpdateVal(ctx context.Context, gameId string, updates client.UpdateOptions, exp *time.Duration) error {
+	if race := s.race; race != nil {
+		s.race = nil
+		race()
+	}
+	return s.MemoryStore.UpdateVal(ctx, gameId, updates, exp)
+}
+
+func TestJoinGameRetriesAfterConflict(t *testing.T) {
+	gameId := createTestGame(t, GameType{Color: "w", Time: common.Time5_2})
+
+	// Black joins elsewhere while white's join is in flight
+	racing := &racingStore{MemoryStore: testStore, race: func() {
+		cache, err := testStore.GetVal(client.Ctx, gameId)
+		if err != nil {
+			panic(err)
+		}
+		users := append(cache.Users, client.User{Id: "black", Color: string(common.Black)})
+		if err := testStore.UpdateVal(client.Ctx, gameId, client.UpdateOptions{Users: &users, Version: &cache.Version}, nil); err != nil {
+			panic(err)
+		}
+	}}
+	client.SetBackend(racing, testStore)
+	defer client.SetBackend(testStore, testStore)
+
+	joinTestGame(t, gameId, common.White)
+
+	cache, err := testStore.GetVal(client.Ctx, gameId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cache.Users) != 2 || cache.StartedAtMs == 0 {
+		t.Errorf("after both joined: users %+v, started at %d", cache.Users, cache.StartedAtMs)
+	}
+}
+
+func TestMoveSurvivesPresenceRace(t *testing.T) {
+	gameId := createTestGame(t, GameType{Color: "w", Time: common.Time5_2})
+	white := dialTest(t, "/ws/game/"+gameId, joinTestGame(t, gameId, common.White))
+	defer white.close()
+	black := dialTest(t, "/ws/game/"+gameId, joinTestGame(t, gameId, common.Black))
+	defer black.close()
+	white.expect(t, common.MsgGameState)
+	black.expect(t, common.MsgGameState)
+
+	// Black's connection blips on another instance while white's move is in flight
+	racing := &racingStore{MemoryStore: testStore, race: func() {
+		if err := setAway(client.Ctx, gameId, string(common.Black), true); err != nil {
+			panic(err)
+		}
+	}}
+	client.SetBackend(racing, testStore)
+	defer client.SetBackend(testStore, testStore)
+
+	white.send(t, common.MsgMove, common.MovePayload{FromSquare: "e2", ToSquare: "e4"})
+	white.expect(t, common.MsgAck)
+	black.expect(t, common.MsgMove)
+}
+
+// creatingStore records the games created through it
+type creatingStore struct {
+	*racingStore
+	created []string
+}
+
+func (s *creatingStore) CreateGame(ctx context.Context, gameId string, cache client.RedisCache, exp *time.Duration) error {
+	s.created = append(s.created, gameId)
+	return s.racingStore.CreateGame(ctx, gameId, cache, exp)
+}
+
+func TestLosingRematchLeavesNoGame(t *testing.T) {
+	gameId := createTestGame(t, GameType{Color: "w", Time: common.Time5_2})
+	white := dialTest(t, "/ws/game/"+gameId, joinTestGame(t, gameId, common.White))
+	defer white.close()
+	black := dialTest(t, "/ws/game/"+gameId, joinTestGame(t, gameId, common.Black))
+	defer black.close()
+	white.expect(t, common.MsgGameState)
+	black.expect(t, common.MsgGameState)
+
+	white.send(t, common.MsgResign, nil)
+	white.expect(t, common.MsgGameOver)
+	black.send(t, common.MsgRematchOffer, nil)
+	white.expect(t, common.MsgRematchOffer)
+
+	// The same accept lands first on another instance
+	elsewhere := "elsewhere"
+	racing := &creatingStore{racingStore: &racingStore{MemoryStore: testStore, race: func() {
+		cache, err := testStore.GetVal(client.Ctx, gameId)
+		if err != nil {
+			panic(err)
+		}
+		if err := testStore.UpdateVal(client.Ctx, gameId, client.UpdateOptions{RematchId: &elsewhere, Version: &cache.Version}, nil); err != nil {
+			panic(err)
+		}
+	}}}
+	client.SetBackend(racing, testStore)
+	defer client.SetBackend(testStore, testStore)
+
+	white.send(t, common.MsgRematchAccept, nil)
+	white.expectError(t, common.ErrInvalidRematch)
+
+	if len(racing.created) != 1 {
+		t.Fatalf("created games %v, want one", racing.created)
+	}
+	if _, err := testStore.GetVal(client.Ctx, racing.created[0]); err != client.ErrNotFound {
+		t.Errorf("unlinked rematch %s: got %v, want it deleted", racing.created[0], err)
+	}
+	cache, err := testStore.GetVal(client.Ctx, gameId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache.RematchId != elsewhere {
+		t.Errorf("finished game links %q, want %q", cache.RematchId, elsewhere)
+	}
+}
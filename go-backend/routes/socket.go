@@ -1,14 +1,14 @@
 package routes
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"os"
-	"strings"
 	"time"
 
-	"github.com/corentings/chess/v2"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"github.com/yashgadle/go-chess/client"
@@ -19,27 +19,33 @@ import (
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	CheckOrigin:     checkOrigin,
 }
 
-func WSEndpoint(gm *common.GameManager) http.HandlerFunc {
-	// Client connection handler
-	return func(w http.ResponseWriter, r *http.Request) {
-		upgrader.CheckOrigin = func(r *http.Request) bool {
-			appEnv := os.Getenv("APP_ENV")
+// checkOrigin accepts any origin in development, and only our own otherwise
+func checkOrigin(r *http.Request) bool {
+	appEnv := os.Getenv("APP_ENV")
 
-			if appEnv == "development" {
-				return true
-			}
+	if appEnv == "development" {
+		return true
+	}
 
-			origin := r.Header.Get("Origin")
-			host := "https://" + r.Host
+	origin := r.Header.Get("Origin")
+	host := "https://" + r.Host
 
-			return origin == host
-		}
+	return origin == host
+}
+
+func WSEndpoint(gm *common.GameManager) http.HandlerFunc {
+	// Keep flag timers in step with moves made on other instances
+	utils.GetPubSubManager(gm).OnEvent(flagTimers.HandleEvent)
 
+	// Client connection handler
+	return func(w http.ResponseWriter, r *http.Request) {
 		ws, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			log.Println("Failed to upgrade")
+			return
 		}
 
 		vars := mux.Vars(r)
@@ -69,15 +75,18 @@ func WSEndpoint(gm *common.GameManager) http.HandlerFunc {
 				user = u
 			}
 		}
-
-		player := &common.Player{
-			Id:    userId,
-			Color: common.PlayerColor(user.Color),
-			Conn:  ws,
-			Send:  make(chan []byte, 16),
+		// Anyone else watches, held back by the spectator delay
+		if user.Color != string(common.White) && user.Color != string(common.Black) {
+			utils.Reject(ws, "you are not playing in this game; watch it at /ws/watch/"+gameId)
+			return
 		}
 
-		utils.StartWriter(player)
+		player := common.NewPlayer(userId, common.PlayerColor(user.Color), ws)
+
+		utils.StartWriter(player.Socket)
+
+		// Make sure this instance can end the game on time
+		flagTimers.Arm(gameId, gameCache)
 
 		if gameCache.LastMoveAtMs != 0 {
 			// Also start clocks if the game has already started
@@ -86,27 +95,50 @@ func WSEndpoint(gm *common.GameManager) http.HandlerFunc {
 				BlackTimeMs:  gameCache.BlackTimeMs,
 				LastMoveAtMs: gameCache.LastMoveAtMs,
 			}
-			utils.WriteSignal(player, common.MsgStartClock, startClockPayload)
+			utils.WriteSignal(player.Socket, common.MsgStartClock, startClockPayload)
 		}
 
 		// Client connected
-		utils.WriteSignal(player, common.MsgSignal, common.SignalPayload{
+		utils.WriteSignal(player.Socket, common.MsgSignal, common.SignalPayload{
 			Message: "connected",
 		})
 
+		// Count this connection so the opponent can see we're here
+		joinPresence(r.Context(), player, gameId)
+		defer leavePresence(player, gameId)
+
+		// Full snapshot, so a reconnecting client can restore everything.
+		// Offers and presence are in it, which is fine now the seat is checked.
+		seq := sendGameState(r.Context(), player, gameId)
+		// The players' room is for the players' eyes only
+		if player.Seated() {
+			sendChatHistory(r.Context(), player.Socket, gameId, player.Id, common.PlayersRoom)
+		}
+
 		gameManager(player, gameId, gameCache.PGN, gm)
 
-		// Subscribe to game events via pub/sub
+		// Follow the game's events from where the snapshot left off, which
+		// includes the start_game just published
 		psm := utils.GetPubSubManager(gm)
-		psm.SubscribeToGame(gameId)
+		psm.SubscribeToGame(gameId, seq)
+
+		handleIncomingMessage(player, r, gameId)
 
-		handleIncomingMessage(ws, r, gameId, userId)
+		// Last one out tears down the game's local state
+		player.Close()
+		gm.Leave(gameId, player)
+		psm.Unsubscribe(gameId)
 	}
 }
 
-func handleIncomingMessage(conn *websocket.Conn, r *http.Request, gameId string, userId string) {
+// handleIncomingMessage reads messages from p until the connection fails.
+// Rejected actions are reported back to p and never end the loop.
+func handleIncomingMessage(p *common.Player, r *http.Request, gameId string) {
+	defer p.Close()
+	utils.WatchConnection(p.Socket)
+
 	for {
-		_, message, err := conn.ReadMessage()
+		_, message, err := p.Conn.ReadMessage()
 		if err != nil {
 			log.Println(err)
 			return
@@ -115,246 +147,168 @@ func handleIncomingMessage(conn *websocket.Conn, r *http.Request, gameId string,
 		var WSMessage common.WSMessage
 		err = json.Unmarshal(message, &WSMessage)
 		if err != nil {
-			log.Println(err)
-			return
+			sendError(p, "", newActionError(common.ErrBadMessage, "message is not valid JSON"))
+			continue
 		}
 
-		gameCache, err := client.GetVal(r.Context(), gameId)
-		if err != nil {
-			log.Println("Game not found")
+		err = handleMessage(r.Context(), p, gameId, WSMessage)
+		switch {
+		case err == nil:
+		case isConflict(err):
+			// Someone else changed the game first; hand the client the current state
+			sendGameState(r.Context(), p, gameId)
+		case errors.Is(err, client.ErrNotFound):
+			sendError(p, WSMessage.RequestId, newActionError(common.ErrGameNotFound, "game not found"))
 			return
+		default:
+			sendError(p, WSMessage.RequestId, err)
 		}
+	}
+}
 
-		var player client.User
-		for _, user := range gameCache.Users {
-			if user.Id == userId {
-				player = user
-			}
-		}
+// joinPresence counts p's connection. If p is coming back after all of their
+// connections dropped, they are no longer away and the opponent is told they
+// reconnected.
+func joinPresence(ctx context.Context, p *common.Player, gameId string) {
+	presence, err := client.GetPresence(ctx, gameId)
+	if err != nil {
+		log.Printf("Failed to read presence for game %s: %v", gameId, err)
+	}
+	_, seen := presence[string(p.Color)]
 
-		pgnReader := strings.NewReader(gameCache.PGN)
-		pgn, err := chess.PGN(pgnReader)
-		if err != nil {
-			log.Println("Invalid PGN")
-			return
+	count, err := client.AddPresence(ctx, gameId, string(p.Color), 1)
+	if err != nil {
+		log.Printf("Failed to record presence for game %s: %v", gameId, err)
+		return
+	}
+	if count == 1 && seen {
+		if err := setAway(ctx, gameId, string(p.Color), false); err != nil {
+			log.Printf("Failed to record return for game %s: %v", gameId, err)
 		}
-		game := chess.NewGame(pgn)
-
-		// Move
-		switch WSMessage.Type {
-		case common.MsgMove:
-			var movePayload common.MovePayload
-			json.Unmarshal(WSMessage.Data, &movePayload)
-
-			//	Clock logic
-			now := time.Now().UnixMilli()
-			turn := game.Position().Turn()
-			whiteTimeMs := gameCache.WhiteTimeMs
-			blackTimeMs := gameCache.BlackTimeMs
-			lastMoveAtMs := now
-
-			// Handle first move (LastMoveAtMs is 0) - don't deduct time
-			if gameCache.LastMoveAtMs == 0 {
-				// First move: just set the timestamp, don't deduct time
-				client.UpdateVal(r.Context(), gameId, client.UpdateOptions{
-					LastMoveAtMs: &lastMoveAtMs,
-				}, nil)
-
-				startClockPayload := common.StartClockPayload{
-					WhiteTimeMs:  gameCache.WhiteTimeMs,
-					BlackTimeMs:  gameCache.BlackTimeMs,
-					LastMoveAtMs: lastMoveAtMs,
-				}
-				startClockPayloadBytes, err := json.Marshal(startClockPayload)
-				if err != nil {
-					log.Println("Error marshalling start clock payload")
-					return
-				}
-
-				startClockEvent := common.PubSubEvent{
-					Type:   common.MsgStartClock,
-					GameId: gameId,
-					Data:   startClockPayloadBytes,
-				}
-
-				startClockEventBytes, err := json.Marshal(startClockEvent)
-				if err != nil {
-					log.Println("Error marshalling start clock event")
-					return
-				}
-
-				err = client.PublishGameEvent(client.Ctx, gameId, startClockEventBytes)
-				if err != nil {
-					log.Println("Error publishing start clock event to Redis pub/sub")
-					return
-				}
-
-			} else {
-				// Calculate move time for subsequent moves
-				moveTimeMs := now - gameCache.LastMoveAtMs
-
-				if turn == chess.White {
-					if moveTimeMs > gameCache.WhiteTimeMs {
-						log.Println("White lost on time")
-						gameEnd := true
-						whiteTimeMs = int64(0)
-						board := game.FEN()
-						client.UpdateVal(r.Context(), gameId, client.UpdateOptions{
-							Board:        &board,
-							GameEnd:      &gameEnd,
-							WhiteTimeMs:  &whiteTimeMs,
-							LastMoveAtMs: &lastMoveAtMs,
-						}, nil)
-						return
-					}
-					whiteTimeMs -= moveTimeMs
-
-				} else {
-					if moveTimeMs > gameCache.BlackTimeMs {
-						log.Println("Black lost on time")
-						gameEnd := true
-						blackTimeMs = int64(0)
-						board := game.FEN()
-						client.UpdateVal(r.Context(), gameId, client.UpdateOptions{
-							Board:        &board,
-							GameEnd:      &gameEnd,
-							BlackTimeMs:  &blackTimeMs,
-							LastMoveAtMs: &lastMoveAtMs,
-						}, nil)
-						return
-					}
-					blackTimeMs -= moveTimeMs
-				}
-			}
+		payload := common.PresencePayload{Color: p.Color}
+		if err := publishEvent(ctx, gameId, p.Id, common.MsgOpponentReconnected, payload); err != nil {
+			log.Printf("Failed to publish reconnect for game %s: %v", gameId, err)
+		}
+	}
+}
 
-			// Make move
-			err = game.PushNotationMove(movePayload.FromSquare+movePayload.ToSquare, chess.UCINotation{}, nil)
-			if err != nil {
-				// invalid move probably
-				log.Println(err)
-				return
-			}
+// leavePresence releases p's connection. Once p has no connections left they
+// are recorded as away, which starts the grace period, and the opponent is told.
+func leavePresence(p *common.Player, gameId string) {
+	count, err := client.AddPresence(client.Ctx, gameId, string(p.Color), -1)
+	if err != nil {
+		log.Printf("Failed to clear presence for game %s: %v", gameId, err)
+		return
+	}
+	if count == 0 {
+		if err := setAway(client.Ctx, gameId, string(p.Color), true); err != nil {
+			log.Printf("Failed to record absence for game %s: %v", gameId, err)
+		}
+		payload := common.PresencePayload{Color: p.Color}
+		if err := publishEvent(client.Ctx, gameId, p.Id, common.MsgOpponentDisconnected, payload); err != nil {
+			log.Printf("Failed to publish disconnect for game %s: %v", gameId, err)
+		}
+	}
+}
 
-			board := game.FEN()
-			pgn := game.String()
-
-			// Check if game has ended
-			if game.Outcome() != chess.NoOutcome {
-				log.Println("Game has ended")
-				gameEnd := true
-				client.UpdateVal(r.Context(), gameId, client.UpdateOptions{
-					Board:        &board,
-					PGN:          &pgn,
-					GameEnd:      &gameEnd,
-					WhiteTimeMs:  &whiteTimeMs,
-					BlackTimeMs:  &blackTimeMs,
-					LastMoveAtMs: &lastMoveAtMs,
-				}, nil)
-			}
+// publishEvent wraps payload in a PubSubEvent and publishes it on the game channel.
+// fromUserId may be empty to deliver the event to both players.
+func publishEvent(ctx context.Context, gameId string, fromUserId string, msgType common.MessageType, payload any) error {
+	event := common.PubSubEvent{
+		Type:       msgType,
+		GameId:     gameId,
+		FromUserId: fromUserId,
+	}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		event.Data = data
+	}
 
-			client.UpdateVal(r.Context(), gameId, client.UpdateOptions{
-				Board:        &board,
-				PGN:          &pgn,
-				WhiteTimeMs:  &whiteTimeMs,
-				BlackTimeMs:  &blackTimeMs,
-				LastMoveAtMs: &lastMoveAtMs,
-			}, nil)
-
-			// Publish move event to Redis pub/sub with clock times
-			movePayloadWithTime := common.MovePayload{
-				FromSquare:  movePayload.FromSquare,
-				ToSquare:    movePayload.ToSquare,
-				WhiteTimeMs: whiteTimeMs,
-				BlackTimeMs: blackTimeMs,
-			}
-			moveData, _ := json.Marshal(movePayloadWithTime)
-			event := common.PubSubEvent{
-				Type:       common.MsgMove,
-				GameId:     gameId,
-				FromUserId: userId,
-				Data:       moveData,
-			}
-			eventBytes, _ := json.Marshal(event)
-			err = client.PublishGameEvent(r.Context(), gameId, eventBytes)
-			if err != nil {
-				log.Println("Error publishing move event to Redis pub/sub")
-				return
-			}
+	eventBytes, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return client.PublishGameEvent(ctx, gameId, eventBytes)
+}
 
-		case common.MsgResign:
-			if player.Color == "w" {
-				game.Resign(chess.White)
-			} else {
-				game.Resign(chess.Black)
-			}
-			board := game.FEN()
-			pgn := game.String()
-			isGameOver := true
-			client.UpdateVal(r.Context(), gameId, client.UpdateOptions{
-				Board:   &board,
-				PGN:     &pgn,
-				GameEnd: &isGameOver,
-			}, nil)
-
-			resignationPayload := common.ExplicitGameOverPayload{
-				GameOverType: "resignation",
-			}
+// isConflict reports whether err means the game changed between our read and our write
+func isConflict(err error) bool {
+	var conflict *client.ConflictError
+	return errors.As(err, &conflict)
+}
 
-			marshalData, _ := json.Marshal(resignationPayload)
+// sendGameState pushes the stored game to p so a client with a stale view can
+// resync. It returns the number of the last event the snapshot reflects.
+// The snapshot holds pending offers and the opponent's presence, so it is
+// only ever sent to a seated player.
+func sendGameState(ctx context.Context, p *common.Player, gameId string) int64 {
+	if !p.Seated() {
+		log.Printf("Refusing game %s snapshot to %s, who is not playing", gameId, p.Id)
+		return 0
+	}
 
-			eventData := common.PubSubEvent{
-				Type:       common.MsgExplicitGameOver,
-				GameId:     gameId,
-				FromUserId: userId,
-				Data:       marshalData,
-			}
-			eventBytes, _ := json.Marshal(eventData)
-
-			client.PublishGameEvent(r.Context(), gameId, eventBytes)
-		case common.MsgDrawOffer:
-			eventData := common.PubSubEvent{
-				Type:       common.MsgDrawOffer,
-				GameId:     gameId,
-				FromUserId: userId,
-			}
-			eventBytes, _ := json.Marshal(eventData)
-			client.PublishGameEvent(r.Context(), gameId, eventBytes)
-		case common.MsgDrawAccept:
-			if err := game.Draw(chess.DrawOffer); err != nil {
-				log.Println("Invalid draw offer")
-				return
-			}
+	// Read the event number first: events published in between are then
+	// replayed on top of the snapshot rather than silently missed
+	seq, err := client.LastGameEventSeq(ctx, gameId)
+	if err != nil {
+		log.Printf("Failed to read event sequence for game %s: %v", gameId, err)
+	}
 
-			board := game.FEN()
-			pgn := game.String()
-			gameEnd := true
-			client.UpdateVal(r.Context(), gameId, client.UpdateOptions{
-				Board:   &board,
-				PGN:     &pgn,
-				GameEnd: &gameEnd,
-			}, nil)
-
-			signalData := common.SignalPayload{
-				Message: "Draw by agreement",
-				PGN:     pgn,
-			}
-			signalBytes, _ := json.Marshal(signalData)
+	gameCache, err := client.GetVal(ctx, gameId)
+	if err != nil {
+		log.Println("Game not found")
+		return seq
+	}
 
-			eventData := common.PubSubEvent{
-				Type:       common.MsgSignal,
-				GameId:     gameId,
-				FromUserId: userId,
-				Data:       signalBytes,
-			}
+	gameState := newGameState(gameCache, time.Now().UnixMilli())
+	gameState.Seq = seq
+	gameState.PlayerColor = p.Color
 
-			eventBytes, _ := json.Marshal(eventData)
+	opponent := string(common.White)
+	if p.Color == common.White {
+		opponent = string(common.Black)
+	}
+	presence, err := client.GetPresence(ctx, gameId)
+	if err != nil {
+		log.Printf("Failed to read presence for game %s: %v", gameId, err)
+	}
+	connected := presence[opponent] > 0
+	gameState.OpponentConnected = &connected
 
-			client.PublishGameEvent(r.Context(), gameId, eventBytes)
+	utils.WriteSignal(p.Socket, common.MsgGameState, gameState)
+	return seq
+}
 
-		default:
-			// ignore unknown message types
+// newGameState builds the part of the snapshot that is the same for everyone,
+// with the clocks read at nowMs
+func newGameState(gameCache *client.RedisCache, nowMs int64) common.GameStatePayload {
+	whiteTimeMs, blackTimeMs := clocksAt(gameCache, nowMs)
+	gameState := common.GameStatePayload{
+		PGN:                gameCache.PGN,
+		FEN:                gameCache.Board,
+		WhiteTimeMs:        whiteTimeMs,
+		BlackTimeMs:        blackTimeMs,
+		LastMoveAtMs:       gameCache.LastMoveAtMs,
+		ServerTimeMs:       nowMs,
+		SideToMove:         sideToMove(gameCache.Board),
+		GameEnd:            gameCache.GameEnd,
+		Result:             gameCache.Result,
+		DrawOffer:          common.PlayerColor(gameCache.DrawOffer.By),
+		RematchOffer:       common.PlayerColor(gameCache.RematchOffer),
+		RematchId:          gameCache.RematchId,
+		VictoryClaimableBy: common.PlayerColor(gameCache.VictoryClaimableBy),
+	}
+	if by := gameCache.Takeback.By; by != "" {
+		plies := 1
+		if sideToMove(gameCache.Board) == common.PlayerColor(by) {
+			plies = 2
 		}
+		gameState.Takeback = &common.TakebackPayload{By: common.PlayerColor(by), Plies: plies}
 	}
+	return gameState
 }
 
 func gameManager(player *common.Player, gameId string, pgn string, gm *common.GameManager) {
@@ -0,0 +1,148 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/yashgadle/go-chess/common"
+	"github.com/yashgadle/go-chess/utils"
+)
+
+func TestSocketsLeaveNothingBehind(t *testing.T) {
+	before := settledGoroutines()
+
+	gameId := createTestGame(t, GameType{Color: "w", Time: common.Time5_2})
+	whiteSession := joinTestGame(t, gameId, common.White)
+	blackSession := joinTestGame(t, gameId, common.Black)
+
+	white := dialTest(t, "/ws/game/"+gameId, whiteSession)
+	black := dialTest(t, "/ws/game/"+gameId, blackSession)
+	spectator := dialTest(t, "/ws/watch/"+gameId, nil)
+	white.expect(t, common.MsgGameState)
+	black.expect(t, common.MsgGameState)
+	spectator.expect(t, common.MsgGameState)
+
+	white.send(t, common.MsgMove, common.MovePayload{FromSquare: "e2", ToSquare: "e4"})
+	black.expect(t, common.MsgMove)
+	spectator.expect(t, common.MsgMove)
+
+	white.close()
+	black.close()
+	spectator.close()
+
+	psm := utils.GetPubSubManager(testGM)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		games := testGM.GameCount()
+		subscribed := psm.SubscribedGames()
+		goroutines := runtime.NumGoroutine()
+		if games == 0 && subscribed == 0 && goroutines <= before {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("after closing every socket: %d games, %d subscriptions, %d goroutines (started with %d)", games, subscribed, goroutines, before)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestOutsiderCannotPlayOrPeek(t *testing.T) {
+	gameId := createTestGame(t, GameType{Color: "w", Time: common.Time5_2, SpectatorDelayPlies: 10})
+	white := dialTest(t, "/ws/game/"+gameId, joinTestGame(t, gameId, common.White))
+	defer white.close()
+	black := dialTest(t, "/ws/game/"+gameId, joinTestGame(t, gameId, common.Black))
+	defer black.close()
+	white.expect(t, common.MsgGameState)
+	black.expect(t, common.MsgGameState)
+
+	white.send(t, common.MsgMove, common.MovePayload{FromSquare: "e2", ToSquare: "e4"})
+	black.expect(t, common.MsgMove)
+
+	outsider := dialTest(t, "/ws/game/"+gameId, http.Header{"Cookie": {"guest_id=outsider"}})
+	defer outsider.close()
+	outsider.expectRejected(t)
+}
+
+func TestGameStateOnlyForSeatedPlayers(t *testing.T) {
+	gameId := createTestGame(t, GameType{Color: "w", Time: common.Time5_2})
+
+	outsider := common.NewPlayer("outsider", "", nil)
+	sendGameState(context.Background(), outsider, gameId)
+	if len(outsider.Send) != 0 {
+		t.Errorf("outsider was sent %s", <-outsider.Send)
+	}
+
+	white := common.NewPlayer("white", common.White, nil)
+	sendGameState(context.Background(), white, gameId)
+	if len(white.Send) != 1 {
+		t.Errorf("white was sent %d messages, want the snapshot", len(white.Send))
+	}
+}
+
+func TestResumeOnlyForSeatedPlayers(t *testing.T) {
+	gameId := createTestGame(t, GameType{Color: "w", Time: common.Time5_2})
+	if err := publishEvent(context.Background(), gameId, "", common.MsgDrawOffer, common.DrawOfferPayload{By: common.White}); err != nil {
+		t.Fatal(err)
+	}
+
+	outsider := common.NewPlayer("outsider", "", nil)
+	err := handleResumeFrom(context.Background(), outsider, gameId, common.WSMessage{Type: common.MsgResumeFrom})
+	var actionErr *actionError
+	if !errors.As(err, &actionErr) || actionErr.Code != common.ErrNotPlayer {
+		t.Errorf("resume_from by an outsider: %v, want %s", err, common.ErrNotPlayer)
+	}
+	if len(outsider.Send) != 0 {
+		t.Errorf("outsider was replayed %s", <-outsider.Send)
+	}
+
+	white := common.NewPlayer("white", common.White, nil)
+	if err := handleResumeFrom(context.Background(), white, gameId, common.WSMessage{Type: common.MsgResumeFrom}); err != nil {
+		t.Fatal(err)
+	}
+	if len(white.Send) == 0 {
+		t.Error("white was replayed nothing")
+	}
+}
+
+// settledGoroutines returns the goroutine count once the followers the
+// process starts in the background, like the lobby's, are up
+func settledGoroutines() int {
+	n := runtime.NumGoroutine()
+	for stable := 0; stable < 5; stable++ {
+		time.Sleep(20 * time.Millisecond)
+		if m := runtime.NumGoroutine(); m != n {
+			n, stable = m, -1
+		}
+	}
+	return n
+}
+
+func TestChatRateLimitSurvivesReconnect(t *testing.T) {
+	gameId := createTestGame(t, GameType{Color: "w", Time: common.Time5_2})
+	header := joinTestGame(t, gameId, common.White)
+
+	// The count is kept with the game, so reconnecting, whether here or to
+	// another instance, doesn't reset it
+	for range 2 {
+		c := dialTest(t, "/ws/game/"+gameId, header)
+		c.expect(t, common.MsgGameState)
+		for range chatRateLimit / 2 {
+			c.send(t, common.MsgChat, common.ChatPayload{Text: "hi"})
+			c.expect(t, common.MsgAck)
+		}
+		c.close()
+	}
+	c := dialTest(t, "/ws/game/"+gameId, header)
+	defer c.close()
+	c.expect(t, common.MsgGameState)
+	for range chatRateLimit % 2 {
+		c.send(t, common.MsgChat, common.ChatPayload{Text: "hi"})
+		c.expect(t, common.MsgAck)
+	}
+	c.send(t, common.MsgChat, common.ChatPayload{Text: "hi"})
+	c.expectError(t, common.ErrRateLimited)
+}
@@ -0,0 +1,313 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/corentings/chess/v2"
+	"github.com/gorilla/mux"
+	"github.com/yashgadle/go-chess/client"
+	"github.com/yashgadle/go-chess/common"
+	"github.com/yashgadle/go-chess/utils"
+)
+
+// WatchEndpoint streams a game to any number of spectators. Each spectator
+// gets a snapshot, then the moves, clocks and result as they happen.
+// Spectators can't take part: apart from their own chat room, anything they
+// send is refused.
+func WatchEndpoint(gm *common.GameManager) http.HandlerFunc {
+	feed := &delayedFeed{gm: gm}
+	utils.GetPubSubManager(gm).OnEvent(feed.HandleEvent)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		gameId := mux.Vars(r)["gameId"]
+		if gameId == "" {
+			http.Error(w, "Game not found", http.StatusNotFound)
+			return
+		}
+
+		// Spectators need a session too, to be told apart in chat
+		userId := utils.SetGuestSession(w, r)
+		ws, err := upgrader.Upgrade(w, r, w.Header())
+		if err != nil {
+			log.Println("Failed to upgrade")
+			return
+		}
+
+		spectator := common.NewSpectator(userId, ws)
+		utils.StartWriter(spectator.Socket)
+
+		gameState, seq, err := spectatorGameState(r.Context(), gameId)
+		if err != nil {
+			log.Println("Game not found")
+			spectator.Close()
+			return
+		}
+		utils.WriteSignal(spectator.Socket, common.MsgGameState, gameState)
+		sendChatHistory(r.Context(), spectator.Socket, gameId, spectator.Id, common.SpectatorsRoom)
+
+		game := gm.GetOrCreateGame(gameId, gameState.PGN)
+		if gameState.SpectatorDelay != nil {
+			game.SetSpectatorDelay(*gameState.SpectatorDelay)
+		}
+		game.AddSpectator(spectator)
+
+		// Follow the game from where the snapshot left off
+		psm := utils.GetPubSubManager(gm)
+		psm.SubscribeToGame(gameId, seq)
+
+		watchUntilClosed(r.Context(), spectator, gameId)
+
+		spectator.Close()
+		gm.Unwatch(gameId, spectator)
+		psm.Unsubscribe(gameId)
+	}
+}
+
+// GameSnapshot returns the same snapshot spectators start from, for clients
+// that only want to look at the game once
+func GameSnapshot(w http.ResponseWriter, r *http.Request) {
+	gameId := mux.Vars(r)["gameId"]
+
+	gameState, _, err := spectatorGameState(r.Context(), gameId)
+	if errors.Is(err, client.ErrNotFound) {
+		http.Error(w, "Game not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error Reading from Redis", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(gameState)
+}
+
+// watchUntilClosed reads from s until the connection fails. Reading keeps
+// pongs and close frames flowing; apart from chat the messages are refused.
+func watchUntilClosed(ctx context.Context, s *common.Spectator, gameId string) {
+	defer s.Close()
+	utils.WatchConnection(s.Socket)
+
+	for {
+		_, message, err := s.Conn.ReadMessage()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		var msg common.WSMessage
+		if err := json.Unmarshal(message, &msg); err != nil {
+			reportError(s.Socket, s.Id, "", newActionError(common.ErrBadMessage, "message is not valid JSON"))
+			continue
+		}
+
+		switch msg.Type {
+		case common.MsgChat:
+			err = sendChat(ctx, gameId, common.SpectatorsRoom, s.Id, "", msg.Data)
+		case common.MsgChatMute:
+			err = handleChatMute(ctx, s.Socket, gameId, s.Id, common.SpectatorsRoom, msg)
+		default:
+			err = newActionError(common.ErrNotPlayer, "spectators cannot send game actions")
+		}
+		if err != nil {
+			reportError(s.Socket, s.Id, msg.RequestId, err)
+		}
+	}
+}
+
+// spectatorGameState builds the snapshot shown to spectators, held back by the
+// game's spectator delay, along with the number of the last event it reflects.
+// Offers and requests between the players are left out.
+func spectatorGameState(ctx context.Context, gameId string) (common.GameStatePayload, int64, error) {
+	// Read the event number first, as sendGameState does
+	seq, err := client.LastGameEventSeq(ctx, gameId)
+	if err != nil {
+		log.Printf("Failed to read event sequence for game %s: %v", gameId, err)
+	}
+
+	gameCache, err := client.GetVal(ctx, gameId)
+	if err != nil {
+		return common.GameStatePayload{}, 0, err
+	}
+
+	view, asOfMs, err := spectatorView(gameCache, time.Now().UnixMilli())
+	if err != nil {
+		return common.GameStatePayload{}, 0, err
+	}
+
+	gameState := newGameState(view, asOfMs)
+	if delay := view.SpectatorDelay; delay.Enabled() {
+		gameState.SpectatorDelay = &delay
+	}
+	return gameState.ForSpectators(), seq, nil
+}
+
+// spectatorView returns the game as spectators may see it at nowMs, and the
+// time its clocks should be read at. With a delay in time the game is shown
+// as it stood that long ago, result included. With a delay in plies the last
+// plies are held back, with the clocks stopped where they were, until the
+// game ends and everything is shown.
+func spectatorView(cache *client.RedisCache, nowMs int64) (*client.RedisCache, int64, error) {
+	delay := cache.SpectatorDelay
+	if !delay.Enabled() {
+		return cache, nowMs, nil
+	}
+
+	pgnOpt, err := chess.PGN(strings.NewReader(cache.PGN))
+	if err != nil {
+		return nil, 0, err
+	}
+	game := chess.NewGame(pgnOpt)
+	plies := len(game.Moves())
+
+	asOfMs := nowMs
+	shown, ended := plies, cache.GameEnd
+	if delay.Ms > 0 {
+		asOfMs = nowMs - delay.Ms
+		if ended && cache.Result != nil && cache.Result.EndedAtMs > asOfMs {
+			ended = false
+		}
+		if !ended {
+			shown = pliesPlayedBy(cache, plies, asOfMs)
+		}
+	} else if !ended {
+		shown = max(plies-delay.Plies, 0)
+	}
+	if shown == plies && ended == cache.GameEnd {
+		return cache, asOfMs, nil
+	}
+
+	view := *cache
+	view.GameEnd = false
+	view.Result = nil
+	if shown < plies {
+		rewound, err := utils.Rewind(game, plies-shown)
+		if err != nil {
+			return nil, 0, err
+		}
+		view.Board = rewound.FEN()
+		view.PGN = rewound.String()
+		// Games from before clock history was kept show the current clocks
+		if shown < len(cache.ClockHistory) {
+			clocks := cache.ClockHistory[shown]
+			view.WhiteTimeMs = clocks.WhiteTimeMs
+			view.BlackTimeMs = clocks.BlackTimeMs
+			view.LastMoveAtMs = clocks.LastMoveAtMs
+		}
+	} else if cache.LastMoveAtMs != 0 {
+		// Every move is out but the end isn't: give the side to move back
+		// the time they used until the game ended, so their clock runs down
+		// as it did
+		usedMs := max(cache.Result.EndedAtMs-cache.LastMoveAtMs, 0)
+		if sideToMove(cache.Board) == common.White {
+			view.WhiteTimeMs += usedMs
+		} else {
+			view.BlackTimeMs += usedMs
+		}
+	}
+	if delay.Plies > 0 {
+		view.LastMoveAtMs = 0
+	}
+	return &view, asOfMs, nil
+}
+
+// pliesPlayedBy counts how many of the game's plies had been played by atMs.
+// Each ply started the clock recorded before the next one; the last ply
+// started the live clock.
+func pliesPlayedBy(cache *client.RedisCache, plies int, atMs int64) int {
+	for ply := range plies {
+		playedAtMs := cache.LastMoveAtMs
+		if ply+1 < len(cache.ClockHistory) {
+			playedAtMs = cache.ClockHistory[ply+1].LastMoveAtMs
+		}
+		if playedAtMs > atMs {
+			return ply
+		}
+	}
+	return plies
+}
+
+// delayedFeed keeps the spectators of games with a spectator delay up to
+// date. Rather than holding each event back, every event a spectator would
+// see triggers a fresh spectator snapshot once the delay has passed, so the
+// feed always agrees with what a spectator joining then is shown.
+type delayedFeed struct {
+	gm *common.GameManager
+	// mu keeps releases in order, so no spectator's view goes backwards
+	mu sync.Mutex
+}
+
+// HandleEvent schedules the release of event to spectators of delayed games
+func (f *delayedFeed) HandleEvent(event common.PubSubEvent) {
+	if !utils.ForSpectators(event.Type) {
+		return
+	}
+	game := f.gm.GetGame(event.GameId)
+	if game == nil || !game.SpectatorDelay().Enabled() {
+		return
+	}
+
+	gameOver := event.Type == common.MsgGameOver
+	release := func() { f.release(event.GameId, gameOver) }
+	if delay := game.SpectatorDelay(); delay.Ms > 0 {
+		time.AfterFunc(time.Duration(delay.Ms)*time.Millisecond, release)
+	} else {
+		go release()
+	}
+}
+
+// release sends the current spectator snapshot of gameId to its spectators,
+// followed by the result if the game's end has just been released
+func (f *delayedFeed) release(gameId string, gameOver bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	game := f.gm.GetGame(gameId)
+	if game == nil {
+		return
+	}
+	spectators := game.Spectators()
+	if len(spectators) == 0 {
+		return
+	}
+
+	gameState, _, err := spectatorGameState(client.Ctx, gameId)
+	if err != nil {
+		log.Printf("Failed to build spectator snapshot for game %s: %v", gameId, err)
+		return
+	}
+	msgs := []common.WSMessage{{Type: common.MsgGameState}}
+	msgs[0].Data, err = json.Marshal(gameState)
+	if err != nil {
+		log.Printf("Failed to marshal spectator snapshot: %v", err)
+		return
+	}
+	if gameOver && gameState.Result != nil {
+		result, err := json.Marshal(gameState.Result)
+		if err != nil {
+			log.Printf("Failed to marshal result: %v", err)
+			return
+		}
+		msgs = append(msgs, common.WSMessage{Type: common.MsgGameOver, Data: result})
+	}
+
+	for _, msg := range msgs {
+		msgBytes, err := json.Marshal(msg)
+		if err != nil {
+			log.Printf("Failed to marshal WSMessage: %v", err)
+			return
+		}
+		for _, spectator := range spectators {
+			if !spectator.TryEnqueue(msgBytes) {
+				log.Printf("Spectator send channel full or closed, dropping delayed update for game %s", gameId)
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// ChatFilter moderates chat before it is relayed. It returns the text to
+// send, possibly altered, or an error to refuse the message outright.
+type ChatFilter interface {
+	Filter(text string) (string, error)
+}
+
+// WordListFilter masks listed words with asterisks. Words match whole and
+// regardless of case.
+type WordListFilter struct {
+	words map[string]bool
+}
+
+func NewWordListFilter(words []string) *WordListFilter {
+	f := &WordListFilter{words: make(map[string]bool, len(words))}
+	for _, word := range words {
+		if word = strings.TrimSpace(word); word != "" {
+			f.words[strings.ToLower(word)] = true
+		}
+	}
+	return f
+}
+
+// LoadWordListFilter reads a word list with one word per line. Blank lines
+// and lines starting with # are ignored.
+func LoadWordListFilter(path string) (*WordListFilter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var words []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words = append(words, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewWordListFilter(words), nil
+}
+
+func (f *WordListFilter) Filter(text string) (string, error) {
+	runes := []rune(text)
+	start := -1
+	for i := 0; i <= len(runes); i++ {
+		if i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i])) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 && f.words[strings.ToLower(string(runes[start:i]))] {
+			for j := start; j < i; j++ {
+				runes[j] = '*'
+			}
+		}
+		start = -1
+	}
+	return string(runes), nil
+}
@@ -1,28 +1,175 @@
-// Package utils Chess time control util
+// Package utils Chess, socket and session helpers
 package utils
 
-type TimeControl string
+import (
+	"fmt"
+	"strings"
 
-const (
-	Time10_5 TimeControl = "10|5"
-	Time5_2  TimeControl = "5|2"
-	Time3_1  TimeControl = "3|1"
-	Time1_0  TimeControl = "1|0"
+	"github.com/corentings/chess/v2"
+	"github.com/yashgadle/go-chess/common"
 )
 
-func GetTime(time TimeControl) int64 {
-	switch time {
-	case Time10_5:
-		return 10 * 60 * 1000
-	case Time5_2:
-		return 5 * 60 * 1000
-	case Time3_1:
-		return 3 * 60 * 1000
-	case Time1_0:
-		return 1 * 60 * 1000
+// CanCheckmate reports whether color could still mate by any series of
+// legal moves, however unlikely (FIDE 6.9). The opponent's pieces count
+// too, since they can block their own king in: a lone knight mates a king
+// that has anything besides, and bishops mate unless every bishop left
+// stands on squares of one shade and the opponent has nothing else.
+func CanCheckmate(pos *chess.Position, color chess.Color) bool {
+	knights := 0
+	// bishops and opponentBishops mark the shades their bishops stand on
+	var bishops, opponentBishops [2]bool
+	opponentOther := false
+	for sq, piece := range pos.Board().SquareMap() {
+		shade := (int(sq.File()) + int(sq.Rank())) % 2
+		if piece.Color() != color {
+			switch piece.Type() {
+			case chess.King:
+			case chess.Bishop:
+				opponentBishops[shade] = true
+			default:
+				opponentOther = true
+			}
+			continue
+		}
+		switch piece.Type() {
+		case chess.King:
+		case chess.Knight:
+			knights++
+		case chess.Bishop:
+			bishops[shade] = true
+		default:
+			return true
+		}
+	}
+
+	hasBishops := bishops[0] || bishops[1]
+	switch {
+	case knights > 1 || (knights == 1 && hasBishops):
+		return true
+	case knights == 1:
+		return opponentOther || opponentBishops[0] || opponentBishops[1]
+	case hasBishops:
+		oneShade := !(bishops[0] && bishops[1])
+		otherShade := (bishops[0] && opponentBishops[1]) || (bishops[1] && opponentBishops[0])
+		return !oneShade || opponentOther || otherShade
 	default:
-		return 5 * 60 * 1000
+		return false
+	}
+}
+
+// PGNWithResult records outcome as the game's result and returns the PGN.
+// Use it for results the chess library can't produce itself, like losing on time.
+func PGNWithResult(game *chess.Game, outcome chess.Outcome, termination string) string {
+	game.AddTagPair("Result", outcome.String())
+	game.AddTagPair("Termination", termination)
+	pgn := strings.TrimSuffix(game.String(), game.Outcome().String())
+	return pgn + outcome.String()
+}
+
+// FindMove looks up the legal move from -> to in game. For pawn promotions,
+// promotion picks the piece ("q", "r", "b" or "n") and defaults to a queen.
+// Any other move must not carry a promotion.
+func FindMove(game *chess.Game, from string, to string, promotion string) (*chess.Move, error) {
+	promo := chess.NoPieceType
+	if promotion != "" {
+		promo = chess.PieceTypeFromString(promotion)
+		switch promo {
+		case chess.Queen, chess.Rook, chess.Bishop, chess.Knight:
+		default:
+			return nil, fmt.Errorf("invalid promotion piece %q", promotion)
+		}
+	}
+
+	var candidates []chess.Move
+	for _, move := range game.ValidMoves() {
+		if move.S1().String() == from && move.S2().String() == to {
+			candidates = append(candidates, move)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("illegal move %s%s", from, to)
+	}
+
+	isPromotion := candidates[0].Promo() != chess.NoPieceType
+	if !isPromotion {
+		if promo != chess.NoPieceType {
+			return nil, fmt.Errorf("move %s%s is not a promotion", from, to)
+		}
+		return &candidates[0], nil
+	}
+
+	if promo == chess.NoPieceType {
+		promo = chess.Queen
+	}
+	for i := range candidates {
+		if candidates[i].Promo() == promo {
+			return &candidates[i], nil
+		}
+	}
+	return nil, fmt.Errorf("illegal promotion %s%s%s", from, to, promo)
+}
+
+// pgnTags are the tag pairs carried over when a game is rebuilt
+var pgnTags = []string{"Event", "Site", "Date", "Round", "White", "Black"}
+
+// Rewind returns a copy of game with its last plies half moves taken back
+func Rewind(game *chess.Game, plies int) (*chess.Game, error) {
+	moves := game.Moves()
+	if plies < 0 || plies > len(moves) {
+		return nil, fmt.Errorf("cannot take back %d of %d moves", plies, len(moves))
+	}
+
+	rewound := chess.NewGame()
+	for _, tag := range pgnTags {
+		if value := game.GetTagPair(tag); value != "" {
+			rewound.AddTagPair(tag, value)
+		}
 	}
 
-	return 5 * 6081000
+	for _, m := range moves[:len(moves)-plies] {
+		move, err := FindMove(rewound, m.S1().String(), m.S2().String(), m.Promo().String())
+		if err == nil {
+			err = rewound.Move(move, nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rewound, nil
+}
+
+// GameOverType maps how the chess library ended a game to the type sent to clients
+func GameOverType(method chess.Method) common.GOType {
+	switch method {
+	case chess.Checkmate:
+		return common.Checkmate
+	case chess.Resignation:
+		return common.Resignation
+	case chess.DrawOffer:
+		return common.DrawByAgreement
+	case chess.Stalemate:
+		return common.Stalemate
+	case chess.ThreefoldRepetition:
+		return common.ThreefoldRepetition
+	case chess.FivefoldRepetition:
+		return common.FivefoldRepetition
+	case chess.FiftyMoveRule:
+		return common.FiftyMoveRule
+	case chess.SeventyFiveMoveRule:
+		return common.SeventyFiveMoveRule
+	case chess.InsufficientMaterial:
+		return common.InsufficientMaterial
+	}
+	return ""
+}
+
+// Winner returns the winning color for outcome, or "" for a draw or unfinished game
+func Winner(outcome chess.Outcome) common.PlayerColor {
+	switch outcome {
+	case chess.WhiteWon:
+		return common.White
+	case chess.BlackWon:
+		return common.Black
+	}
+	return ""
 }
@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/corentings/chess/v2"
+)
+
+// promotionFEN has a white pawn on a7 ready to promote and a pawn on h2
+// that can't
+const promotionFEN = "8/P7/8/8/8/8/7P/k6K w - - 0 1"
+
+func TestFindMove(t *testing.T) {
+	tests := []struct {
+		name      string
+		from, to  string
+		promotion string
+		want      chess.PieceType
+		wantErr   bool
+	}{
+		{name: "queen", from: "a7", to: "a8", promotion: "q", want: chess.Queen},
+		{name: "rook", from: "a7", to: "a8", promotion: "r", want: chess.Rook},
+		{name: "bishop", from: "a7", to: "a8", promotion: "b", want: chess.Bishop},
+		{name: "knight", from: "a7", to: "a8", promotion: "n", want: chess.Knight},
+		{name: "defaults to queen", from: "a7", to: "a8", want: chess.Queen},
+		{name: "invalid piece", from: "a7", to: "a8", promotion: "k", wantErr: true},
+		{name: "promotion on a plain move", from: "h2", to: "h3", promotion: "q", wantErr: true},
+		{name: "plain move", from: "h2", to: "h3", want: chess.NoPieceType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fen, err := chess.FEN(promotionFEN)
+			if err != nil {
+				t.Fatal(err)
+			}
+			game := chess.NewGame(fen)
+
+			move, err := FindMove(game, tt.from, tt.to, tt.promotion)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("FindMove(%s, %s, %q) = %s, want an error", tt.from, tt.to, tt.promotion, move)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("FindMove(%s, %s, %q): %v", tt.from, tt.to, tt.promotion, err)
+			}
+			if move.Promo() != tt.want {
+				t.Errorf("FindMove(%s, %s, %q) promotes to %v, want %v", tt.from, tt.to, tt.promotion, move.Promo(), tt.want)
+			}
+		})
+	}
+}
+
+func TestCanCheckmate(t *testing.T) {
+	tests := []struct {
+		name string
+		fen  string
+		want bool
+	}{
+		{name: "lone king", fen: "4k3/8/8/8/8/8/8/4K3 w - - 0 1", want: false},
+		{name: "rook", fen: "4k3/8/8/8/8/8/8/R3K3 w - - 0 1", want: true},
+		{name: "pawn", fen: "4k3/8/8/8/8/8/P7/4K3 w - - 0 1", want: true},
+		{name: "knight against a lone king", fen: "4k3/8/8/8/8/8/8/1N2K3 w - - 0 1", want: false},
+		{name: "knight against a rook", fen: "r3k3/8/8/8/8/8/8/1N2K3 w - - 0 1", want: true},
+		{name: "knight against a knight", fen: "1n2k3/8/8/8/8/8/8/1N2K3 w - - 0 1", want: true},
+		{name: "bishop against a lone king", fen: "4k3/8/8/8/8/8/8/2B1K3 w - - 0 1", want: false},
+		{name: "bishop against a pawn", fen: "4k3/p7/8/8/8/8/8/2B1K3 w - - 0 1", want: true},
+		{name: "bishops of one shade against a lone king", fen: "4k3/8/8/8/8/8/8/B1B1K3 w - - 0 1", want: false},
+		{name: "bishops of both shades", fen: "4k3/8/8/8/8/8/8/2BBK3 w - - 0 1", want: true},
+		{name: "bishops on the same shade", fen: "4kb2/8/8/8/8/8/8/2B1K3 w - - 0 1", want: false},
+		{name: "bishops on opposite shades", fen: "2b1k3/8/8/8/8/8/8/2B1K3 w - - 0 1", want: true},
+		{name: "knight and bishop", fen: "4k3/8/8/8/8/8/8/1NB1K3 w - - 0 1", want: true},
+		{name: "two knights", fen: "4k3/8/8/8/8/8/8/1N2K1N1 w - - 0 1", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fen, err := chess.FEN(tt.fen)
+			if err != nil {
+				t.Fatal(err)
+			}
+			game := chess.NewGame(fen)
+			if got := CanCheckmate(game.Position(), chess.White); got != tt.want {
+				t.Errorf("CanCheckmate(%s, White) = %v, want %v", tt.fen, got, tt.want)
+			}
+		})
+	}
+}
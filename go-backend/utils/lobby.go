@@ -0,0 +1,146 @@
+package utils
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/yashgadle/go-chess/client"
+	"github.com/yashgadle/go-chess/common"
+)
+
+// Lobby relays the shared lobby feed to the lobby members connected to this
+// instance. Unlike games, the feed is followed for as long as the process runs.
+type Lobby struct {
+	// mu guards members and orders joins against forwarded events
+	mu      sync.Mutex
+	members map[*common.LobbyMember]struct{}
+}
+
+var lobby *Lobby
+var lobbyOnce sync.Once
+
+// lobbyRetryDelay is how long the lobby waits before following the feed
+// again after losing it
+const lobbyRetryDelay = time.Second
+
+// GetLobby returns this instance's lobby. The first call starts following
+// the feed from its latest event, so anything that happens after it
+// returns reaches the members.
+func GetLobby() *Lobby {
+	lobbyOnce.Do(func() {
+		lobby = &Lobby{members: make(map[*common.LobbyMember]struct{})}
+		afterSeq, err := client.LastGameEventSeq(client.Ctx, common.LobbyFeed)
+		if err != nil {
+			log.Printf("Failed to read lobby event sequence: %v", err)
+		}
+		go lobby.follow(afterSeq)
+	})
+	return lobby
+}
+
+// Join adds m to the lobby once welcome, which typically sends the current
+// seeks, has run. No event is forwarded to anyone in the meantime, so m
+// never receives one older than what welcome sent.
+func (l *Lobby) Join(m *common.LobbyMember, welcome func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	welcome()
+	l.members[m] = struct{}{}
+}
+
+func (l *Lobby) Leave(m *common.LobbyMember) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.members, m)
+}
+
+// follow forwards the feed's events numbered above afterSeq, picking up
+// where it left off whenever the subscription is lost
+func (l *Lobby) follow(afterSeq int64) {
+	for {
+		sub, err := client.SubscribeToGame(client.Ctx, common.LobbyFeed, afterSeq)
+		if err != nil {
+			log.Printf("Failed to subscribe to the lobby: %v", err)
+			time.Sleep(lobbyRetryDelay)
+			continue
+		}
+		log.Printf("Subscribed to the lobby after event %d", afterSeq)
+
+		for msg := range sub.Channel() {
+			var event common.PubSubEvent
+			if err := json.Unmarshal(msg, &event); err != nil {
+				log.Printf("Failed to unmarshal lobby event: %v", err)
+				continue
+			}
+			afterSeq = event.Seq
+			l.forward(event)
+		}
+
+		log.Println("Lobby subscription closed")
+		time.Sleep(lobbyRetryDelay)
+	}
+}
+
+func (l *Lobby) forward(event common.PubSubEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for m := range l.members {
+		msgBytes, err := lobbyMessageFor(event, m)
+		if err != nil {
+			log.Printf("Failed to marshal WSMessage: %v", err)
+			continue
+		}
+		if msgBytes == nil {
+			continue
+		}
+		if !m.TryEnqueue(msgBytes) {
+			log.Printf("Lobby member %s send channel full or closed, dropping %s", m.Id, event.Type)
+		}
+	}
+}
+
+// lobbyMessageFor builds the WSMessage m receives for event, or nil if the
+// event isn't for m. A found game reaches only its two players, each with
+// their own color and URL.
+func lobbyMessageFor(event common.PubSubEvent, m *common.LobbyMember) ([]byte, error) {
+	var dataToSend json.RawMessage = event.Data
+
+	// Tell the poster which seek is theirs
+	if event.Type == common.MsgSeek && event.FromUserId == m.Id {
+		var seek common.Seek
+		if err := json.Unmarshal(event.Data, &seek); err == nil {
+			seek.Mine = true
+			if customData, err := json.Marshal(seek); err == nil {
+				dataToSend = customData
+			}
+		}
+	}
+
+	if event.Type == common.MsgGameFound {
+		var gameFoundPayload common.GameFoundPayload
+		if err := json.Unmarshal(event.Data, &gameFoundPayload); err != nil {
+			return nil, err
+		}
+		color, ok := gameFoundPayload.Colors[m.Id]
+		if !ok {
+			return nil, nil
+		}
+		gameFoundPayload.PlayerColor = color
+		gameFoundPayload.GameUrl = gameFoundPayload.Urls[color]
+		gameFoundPayload.Colors = nil
+		gameFoundPayload.Urls = nil
+		customData, err := json.Marshal(gameFoundPayload)
+		if err != nil {
+			return nil, err
+		}
+		dataToSend = customData
+	}
+
+	return json.Marshal(common.WSMessage{
+		Type: event.Type,
+		Data: dataToSend,
+	})
+}
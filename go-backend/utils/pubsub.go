@@ -5,19 +5,29 @@ import (
 	"encoding/json"
 	"log"
 	"sync"
+	"time"
 
-	"github.com/go-redis/redis/v8"
 	"github.com/yashgadle/go-chess/client"
 	"github.com/yashgadle/go-chess/common"
 )
 
-// PubSubManager manages Redis pub/sub subscriptions for games
+// PubSubManager manages game event subscriptions on the configured client.EventBus
 type PubSubManager struct {
 	gm     *common.GameManager
-	subs   map[string]*redis.PubSub
+	subs   map[string]client.Subscription
 	subsMu sync.RWMutex
-	ctx    context.Context
-	cancel context.CancelFunc
+	// lastSeq is the last event delivered for each game, where a lost
+	// subscription picks up again
+	lastSeq map[string]int64
+	// refs counts the local sockets using each subscription
+	refs map[string]int
+	// lingers close the sockets of finished games after finishedGameLinger
+	lingers map[string]*time.Timer
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	listeners   []func(common.PubSubEvent)
+	listenersMu sync.RWMutex
 }
 
 var pubSubManager *PubSubManager
@@ -27,39 +37,135 @@ func GetPubSubManager(gm *common.GameManager) *PubSubManager {
 	pubSubOnce.Do(func() {
 		ctx, cancel := context.WithCancel(context.Background())
 		pubSubManager = &PubSubManager{
-			gm:     gm,
-			subs:   make(map[string]*redis.PubSub),
-			ctx:    ctx,
-			cancel: cancel,
+			gm:      gm,
+			subs:    make(map[string]client.Subscription),
+			lastSeq: make(map[string]int64),
+			refs:    make(map[string]int),
+			lingers: make(map[string]*time.Timer),
+			ctx:     ctx,
+			cancel:  cancel,
 		}
 		go pubSubManager.StartSubscriber()
 	})
 	return pubSubManager
 }
 
-func (psm *PubSubManager) SubscribeToGame(gameId string) {
+// finishedGameLinger is how long sockets stay open after their game ends,
+// e.g. to agree on a rematch, before they are closed
+const finishedGameLinger = 5 * time.Minute
+
+// SubscribeToGame follows gameId's events numbered above afterSeq for one
+// local socket. If this instance already follows the game it keeps its
+// current position. Every call must be paired with Unsubscribe.
+func (psm *PubSubManager) SubscribeToGame(gameId string, afterSeq int64) {
 	psm.subsMu.Lock()
 	defer psm.subsMu.Unlock()
 
+	psm.refs[gameId]++
 	if _, exists := psm.subs[gameId]; exists {
 		return // already subscribed
 	}
+	psm.subscribe(gameId, afterSeq)
+}
+
+// Unsubscribe releases one socket's hold on gameId. The last one out closes
+// the subscription.
+func (psm *PubSubManager) Unsubscribe(gameId string) {
+	psm.subsMu.Lock()
+	defer psm.subsMu.Unlock()
+
+	psm.refs[gameId]--
+	if psm.refs[gameId] > 0 {
+		return
+	}
+
+	if sub := psm.subs[gameId]; sub != nil {
+		if err := sub.Close(); err != nil {
+			log.Printf("Failed to close subscription for game %s: %v", gameId, err)
+		}
+	}
+	if t := psm.lingers[gameId]; t != nil {
+		t.Stop()
+	}
+	delete(psm.subs, gameId)
+	delete(psm.refs, gameId)
+	delete(psm.lastSeq, gameId)
+	delete(psm.lingers, gameId)
+	log.Printf("Unsubscribed from game %s", gameId)
+}
+
+// SubscribedGames returns how many games this instance follows
+func (psm *PubSubManager) SubscribedGames() int {
+	psm.subsMu.RLock()
+	defer psm.subsMu.RUnlock()
+	return len(psm.subs)
+}
+
+// lingerFinishedGame closes the local sockets of gameId a while after it
+// ended, and after delayed spectators have seen the end too; each socket
+// unsubscribing as it goes tears everything down
+func (psm *PubSubManager) lingerFinishedGame(gameId string) {
+	psm.subsMu.Lock()
+	defer psm.subsMu.Unlock()
+
+	if _, exists := psm.subs[gameId]; !exists || psm.lingers[gameId] != nil {
+		return
+	}
+	linger := finishedGameLinger
+	if game := psm.gm.GetGame(gameId); game != nil {
+		linger += time.Duration(game.SpectatorDelay().Ms) * time.Millisecond
+	}
+	psm.lingers[gameId] = time.AfterFunc(linger, func() {
+		if game := psm.gm.GetGame(gameId); game != nil {
+			for _, player := range game.Players() {
+				player.Close()
+			}
+			for _, spectator := range game.Spectators() {
+				spectator.Close()
+			}
+		}
+	})
+}
 
-	pubsub, err := client.SubscribeToGame(psm.ctx, gameId)
+// subscribe opens the subscription for gameId. Callers must hold psm.subsMu.
+func (psm *PubSubManager) subscribe(gameId string, afterSeq int64) {
+	sub, err := client.SubscribeToGame(psm.ctx, gameId, afterSeq)
 	if err != nil {
 		log.Printf("Failed to subscribe to game %s: %v", gameId, err)
 		return
 	}
 
-	psm.subs[gameId] = pubsub
-	log.Printf("Subscribed to game channel: game:%s", gameId)
+	psm.subs[gameId] = sub
+	psm.lastSeq[gameId] = afterSeq
+	log.Printf("Subscribed to game %s after event %d", gameId, afterSeq)
 
 	// Start a goroutine to handle messages for this subscription
-	go psm.HandleSubscription(gameId, pubsub)
+	go psm.HandleSubscription(gameId, sub)
 }
 
-func (psm *PubSubManager) HandleSubscription(gameId string, pubsub *redis.PubSub) {
-	ch := pubsub.Channel()
+// resubscribe replaces a subscription that ended on its own, resuming after
+// the last event it delivered
+func (psm *PubSubManager) resubscribe(gameId string, sub client.Subscription) {
+	psm.subsMu.Lock()
+	defer psm.subsMu.Unlock()
+
+	if psm.subs[gameId] != sub {
+		return // closed on purpose or already replaced
+	}
+	delete(psm.subs, gameId)
+	psm.subscribe(gameId, psm.lastSeq[gameId])
+}
+
+// OnEvent registers fn to be called for every event received on a subscribed game,
+// before it is forwarded to local players. fn must not block.
+func (psm *PubSubManager) OnEvent(fn func(common.PubSubEvent)) {
+	psm.listenersMu.Lock()
+	defer psm.listenersMu.Unlock()
+	psm.listeners = append(psm.listeners, fn)
+}
+
+func (psm *PubSubManager) HandleSubscription(gameId string, sub client.Subscription) {
+	ch := sub.Channel()
 	for {
 		select {
 		case <-psm.ctx.Done():
@@ -67,16 +173,26 @@ func (psm *PubSubManager) HandleSubscription(gameId string, pubsub *redis.PubSub
 		case msg, ok := <-ch:
 			if !ok {
 				log.Printf("Subscription channel closed for game %s", gameId)
+				psm.resubscribe(gameId, sub)
 				return
 			}
 
 			// Parse and forward event
 			var event common.PubSubEvent
-			if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+			if err := json.Unmarshal(msg, &event); err != nil {
 				log.Printf("Failed to unmarshal pub/sub event: %v", err)
 				continue
 			}
 
+			psm.subsMu.Lock()
+			psm.lastSeq[gameId] = event.Seq
+			psm.subsMu.Unlock()
+
+			if event.Type == common.MsgGameOver {
+				psm.lingerFinishedGame(gameId)
+			}
+
+			psm.notifyListeners(event)
 			psm.ForwardEvent(event)
 		}
 	}
@@ -88,6 +204,14 @@ func (psm *PubSubManager) StartSubscriber() {
 	<-psm.ctx.Done()
 }
 
+func (psm *PubSubManager) notifyListeners(event common.PubSubEvent) {
+	psm.listenersMu.RLock()
+	defer psm.listenersMu.RUnlock()
+	for _, fn := range psm.listeners {
+		fn(event)
+	}
+}
+
 func (psm *PubSubManager) ForwardEvent(event common.PubSubEvent) {
 	game := psm.gm.GetGame(event.GameId)
 
@@ -95,49 +219,220 @@ func (psm *PubSubManager) ForwardEvent(event common.PubSubEvent) {
 		return
 	}
 
-	// Forward to both players (they'll ignore if it's from themselves)
-	var players []*common.Player
-	if game.White != nil {
-		players = append(players, game.White)
+	// Forward to both players; the one who caused the event gets an ack
+	for _, player := range game.Players() {
+		msgBytes, err := messageFor(event, player)
+		if err != nil {
+			log.Printf("Failed to marshal WSMessage: %v", err)
+			continue
+		}
+
+		if !player.TryEnqueue(msgBytes) {
+			// The client spots the gap in sequence numbers and resumes
+			log.Printf("Player %s send channel full or closed, dropping event %d", player.Id, event.Seq)
+		}
+	}
+
+	psm.forwardToSpectators(game, event)
+}
+
+// spectatorEvents are the events spectators see: the moves, the clocks and
+// the result. Everything else concerns only the players.
+var spectatorEvents = map[common.MessageType]bool{
+	common.MsgStartGame:  true,
+	common.MsgStartClock: true,
+	common.MsgMove:       true,
+	common.MsgGameState:  true,
+	common.MsgGameOver:   true,
+}
+
+// ForSpectators reports whether events of msgType are shown to spectators
+func ForSpectators(msgType common.MessageType) bool {
+	return spectatorEvents[msgType]
+}
+
+// forwardToSpectators sends event live to the game's spectators. Games with a
+// spectator delay are left to whoever feeds the delayed view, except for the
+// spectators' own chat, which has nothing to give away.
+func (psm *PubSubManager) forwardToSpectators(game *common.Game, event common.PubSubEvent) {
+	if event.Type == common.MsgChat {
+		forwardSpectatorChat(game, event)
+		return
+	}
+	if !spectatorEvents[event.Type] || game.SpectatorDelay().Enabled() {
+		return
+	}
+	spectators := game.Spectators()
+	if len(spectators) == 0 {
+		return
+	}
+
+	msgBytes, err := spectatorMessage(event)
+	if err != nil {
+		log.Printf("Failed to marshal WSMessage: %v", err)
+		return
 	}
-	if game.Black != nil {
-		players = append(players, game.Black)
+	for _, spectator := range spectators {
+		if !spectator.TryEnqueue(msgBytes) {
+			log.Printf("Spectator send channel full or closed, dropping event %d", event.Seq)
+		}
 	}
+}
 
-	for _, player := range players {
-		// Skip if this event came from this player (avoid echo)
-		if event.FromUserId != "" && player.Id == event.FromUserId {
+// forwardSpectatorChat sends chat from the spectators' room to every spectator
+// who hasn't muted it. Senders always see their own messages.
+func forwardSpectatorChat(game *common.Game, event common.PubSubEvent) {
+	if chatRoom(event) != common.SpectatorsRoom {
+		return
+	}
+	msgBytes, err := spectatorMessage(event)
+	if err != nil {
+		log.Printf("Failed to marshal WSMessage: %v", err)
+		return
+	}
+	for _, spectator := range game.Spectators() {
+		if spectator.ChatMuted.Load() && spectator.Id != event.FromUserId {
 			continue
 		}
+		if !spectator.TryEnqueue(msgBytes) {
+			log.Printf("Spectator send channel full or closed, dropping chat for game %s", event.GameId)
+		}
+	}
+}
+
+// chatRoom returns the room a chat event was sent to
+func chatRoom(event common.PubSubEvent) common.ChatRoom {
+	var chatPayload common.ChatPayload
+	if err := json.Unmarshal(event.Data, &chatPayload); err != nil {
+		return ""
+	}
+	return chatPayload.Room
+}
+
+// spectatorMessage builds the WSMessage spectators receive for event. It has
+// no player color, and no sequence number since spectators only see some events.
+func spectatorMessage(event common.PubSubEvent) ([]byte, error) {
+	var dataToSend json.RawMessage = event.Data
+	// Snapshots broadcast to the players, e.g. after a takeback, carry what
+	// only they may see; unlike other events, they are never passed on as is
+	if event.Type == common.MsgGameState {
+		var gameStatePayload common.GameStatePayload
+		if err := json.Unmarshal(event.Data, &gameStatePayload); err != nil {
+			return nil, err
+		}
+		customData, err := json.Marshal(gameStatePayload.ForSpectators())
+		if err != nil {
+			return nil, err
+		}
+		dataToSend = customData
+	}
+	if event.Type == common.MsgStartGame {
+		var startGamePayload common.StartGamePayload
+		if err := json.Unmarshal(event.Data, &startGamePayload); err == nil {
+			startGamePayload.PlayerColor = ""
+			if customData, err := json.Marshal(startGamePayload); err == nil {
+				dataToSend = customData
+			}
+		}
+	}
+
+	return json.Marshal(common.WSMessage{
+		Type: event.Type,
+		Data: dataToSend,
+	})
+}
+
+// messageFor builds the WSMessage player receives for event. The player who
+// caused the event gets an ack carrying its sequence number instead of an
+// echo, and chat the player doesn't get becomes a skip, so every player
+// still sees each number exactly once.
+func messageFor(event common.PubSubEvent, player *common.Player) ([]byte, error) {
+	if event.FromUserId != "" && player.Id == event.FromUserId {
+		return json.Marshal(common.WSMessage{
+			Type: common.MsgAck,
+			Seq:  event.Seq,
+		})
+	}
+
+	// The players' room reaches only the two players, live or replayed
+	if event.Type == common.MsgChat && (!player.Seated() || player.ChatMuted.Load() || chatRoom(event) != common.PlayersRoom) {
+		return json.Marshal(common.WSMessage{
+			Type: common.MsgSkip,
+			Seq:  event.Seq,
+		})
+	}
+
+	// For start_game events, customize the payload with each player's color
+	var dataToSend json.RawMessage = event.Data
+	if event.Type == common.MsgStartGame {
+		var startGamePayload common.StartGamePayload
+		if err := json.Unmarshal(event.Data, &startGamePayload); err == nil {
+			// Set the player's actual color instead of the generic one
+			startGamePayload.PlayerColor = player.Color
+			if customData, err := json.Marshal(startGamePayload); err == nil {
+				dataToSend = customData
+			}
+		}
+	}
+
+	// Broadcast snapshots carry the recipient's color like direct ones do
+	if event.Type == common.MsgGameState {
+		var gameStatePayload common.GameStatePayload
+		if err := json.Unmarshal(event.Data, &gameStatePayload); err == nil {
+			gameStatePayload.PlayerColor = player.Color
+			if customData, err := json.Marshal(gameStatePayload); err == nil {
+				dataToSend = customData
+			}
+		}
+	}
 
-		// For start_game events, customize the payload with each player's color
-		var dataToSend json.RawMessage = event.Data
-		if event.Type == common.MsgStartGame {
-			var startGamePayload common.StartGamePayload
-			if err := json.Unmarshal(event.Data, &startGamePayload); err == nil {
-				// Set the player's actual color instead of the generic one
-				startGamePayload.PlayerColor = player.Color
-				if customData, err := json.Marshal(startGamePayload); err == nil {
-					dataToSend = customData
-				}
+	// For rematch events, hand each player the URL for their new color
+	if event.Type == common.MsgRematch {
+		var rematchPayload common.RematchPayload
+		if err := json.Unmarshal(event.Data, &rematchPayload); err == nil {
+			rematchPayload.PlayerColor = common.White
+			if player.Color == common.White {
+				rematchPayload.PlayerColor = common.Black
+			}
+			rematchPayload.GameUrl = rematchPayload.Urls[rematchPayload.PlayerColor]
+			rematchPayload.Urls = nil
+			if customData, err := json.Marshal(rematchPayload); err == nil {
+				dataToSend = customData
 			}
 		}
+	}
+
+	return json.Marshal(common.WSMessage{
+		Type: event.Type,
+		Data: dataToSend,
+		Seq:  event.Seq,
+	})
+}
+
+// ReplayEvents sends p every event of gameId numbered above afterSeq, in
+// order. Live events may interleave with the replay, so clients should drop
+// any sequence number they have already handled. client.ErrEventsExpired
+// means the events are gone and p needs a full snapshot instead.
+func ReplayEvents(ctx context.Context, p *common.Player, gameId string, afterSeq int64) error {
+	events, err := client.GameEventsSince(ctx, gameId, afterSeq)
+	if err != nil {
+		return err
+	}
 
-		// Create WSMessage and send
-		wsMsg := common.WSMessage{
-			Type: event.Type,
-			Data: dataToSend,
+	for _, raw := range events {
+		var event common.PubSubEvent
+		if err := json.Unmarshal(raw, &event); err != nil {
+			log.Printf("Failed to unmarshal logged event: %v", err)
+			continue
 		}
-		msgBytes, err := json.Marshal(wsMsg)
+		msgBytes, err := messageFor(event, p)
 		if err != nil {
 			log.Printf("Failed to marshal WSMessage: %v", err)
 			continue
 		}
-
-		select {
-		case player.Send <- msgBytes:
-		default:
-			log.Printf("Player %s send channel full, dropping message", player.Id)
+		if !p.Enqueue(msgBytes) {
+			return nil
 		}
 	}
+	return nil
 }
@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/yashgadle/go-chess/common"
+)
+
+func TestSpectatorMessageStripsGameState(t *testing.T) {
+	connected := true
+	gameState := common.GameStatePayload{
+		FEN:                "rnbqkbnr/pppppppp/8/8/4P3/8/PPPP1PPP/RNBQKBNR b KQkq - 0 1",
+		DrawOffer:          common.White,
+		Takeback:           &common.TakebackPayload{By: common.Black, Plies: 1},
+		RematchOffer:       common.Black,
+		RematchId:          "rematch",
+		VictoryClaimableBy: common.White,
+		PlayerColor:        common.White,
+		OpponentConnected:  &connected,
+	}
+	data, err := json.Marshal(gameState)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgBytes, err := spectatorMessage(common.PubSubEvent{Type: common.MsgGameState, Data: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg common.WSMessage
+	if err := json.Unmarshal(msgBytes, &msg); err != nil {
+		t.Fatal(err)
+	}
+	var got common.GameStatePayload
+	if err := json.Unmarshal(msg.Data, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	want := common.GameStatePayload{FEN: gameState.FEN}
+	gotJSON, _ := json.Marshal(got)
+	wantJSON, _ := json.Marshal(want)
+	if string(gotJSON) != string(wantJSON) {
+		t.Errorf("spectators got %s, want %s", gotJSON, wantJSON)
+	}
+}
+
+func TestMessageForKeepsPlayerChatToPlayers(t *testing.T) {
+	data, err := json.Marshal(common.ChatPayload{Room: common.PlayersRoom, Color: common.White, Text: "gl"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := common.PubSubEvent{Type: common.MsgChat, Data: data, GameId: "game", FromUserId: "white", Seq: 7}
+
+	tests := []struct {
+		name  string
+		color common.PlayerColor
+		want  common.MessageType
+	}{
+		{name: "opponent", color: common.Black, want: common.MsgChat},
+		{name: "not seated", color: "", want: common.MsgSkip},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msgBytes, err := messageFor(event, common.NewPlayer("reader", tt.color, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var msg common.WSMessage
+			if err := json.Unmarshal(msgBytes, &msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type != tt.want || msg.Seq != event.Seq {
+				t.Errorf("got %s #%d, want %s #%d", msg.Type, msg.Seq, tt.want, event.Seq)
+			}
+			if tt.want == common.MsgSkip && len(msg.Data) != 0 {
+				t.Errorf("skip carries %s", msg.Data)
+			}
+		})
+	}
+}
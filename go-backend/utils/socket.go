@@ -3,12 +3,15 @@ package utils
 import (
 	"encoding/json"
 	"log"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/yashgadle/go-chess/common"
 )
 
-func WriteSignal(p *common.Player, msgType common.MessageType, message any) {
+func WriteSignal(s *common.Socket, msgType common.MessageType, message any) {
 	var payload json.RawMessage
 
 	switch m := message.(type) {
@@ -35,16 +38,92 @@ func WriteSignal(p *common.Player, msgType common.MessageType, message any) {
 		return
 	}
 
-	p.Send <- data
+	s.Enqueue(data)
+}
+
+// Keepalive settings. WS_PING_INTERVAL, WS_PONG_WAIT and WS_WRITE_WAIT
+// override them, e.g. "20s".
+var (
+	// pingInterval is how often the server pings each client
+	pingInterval = sync.OnceValue(func() time.Duration {
+		interval := DurationFromEnv("WS_PING_INTERVAL", 25*time.Second)
+		if wait := pongWait(); interval >= wait {
+			interval = wait * 9 / 10
+			log.Printf("WS_PING_INTERVAL must be shorter than WS_PONG_WAIT, using %s", interval)
+		}
+		return interval
+	})
+	// pongWait is how long a client may stay silent before it counts as gone
+	pongWait = sync.OnceValue(func() time.Duration {
+		return DurationFromEnv("WS_PONG_WAIT", 60*time.Second)
+	})
+	// writeWait bounds each write, so a stuck peer can't hold up its writer
+	writeWait = sync.OnceValue(func() time.Duration {
+		return DurationFromEnv("WS_WRITE_WAIT", 10*time.Second)
+	})
+)
+
+// DurationFromEnv parses the environment variable name as a duration, e.g.
+// "45s", falling back to defaultValue when it is unset or invalid
+func DurationFromEnv(name string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Printf("Invalid %s %q, using %s", name, value, defaultValue)
+		return defaultValue
+	}
+	return d
+}
+
+// Reject refuses conn with a close frame carrying reason, for connections
+// turned away before their writer has started
+func Reject(conn *websocket.Conn, reason string) {
+	msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason)
+	if err := conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait())); err != nil {
+		log.Println(err)
+	}
+	conn.Close()
+}
+
+// WatchConnection makes reads on s fail once the client has not answered a
+// ping for pongWait, so half-open connections are noticed and dropped.
+// Call it before reading from s.Conn.
+func WatchConnection(s *common.Socket) {
+	s.Conn.SetReadDeadline(time.Now().Add(pongWait()))
+	s.Conn.SetPongHandler(func(string) error {
+		return s.Conn.SetReadDeadline(time.Now().Add(pongWait()))
+	})
 }
 
 // Only one writer per connection. gorilla/websocket does not support multiple writers.
-func StartWriter(p *common.Player) {
+// The writer also pings the client every pingInterval. It stops once s is
+// closed, or closes s itself if a write fails.
+func StartWriter(s *common.Socket) {
 	go func() {
-		for msg := range p.Send {
-			err := p.Conn.WriteMessage(websocket.TextMessage, msg)
-			if err != nil {
-				log.Println(err)
+		ticker := time.NewTicker(pingInterval())
+		defer ticker.Stop()
+
+		for {
+			select {
+			case msg := <-s.Send:
+				s.Conn.SetWriteDeadline(time.Now().Add(writeWait()))
+				err := s.Conn.WriteMessage(websocket.TextMessage, msg)
+				if err != nil {
+					log.Println(err)
+					s.Close()
+					return
+				}
+			case <-ticker.C:
+				s.Conn.SetWriteDeadline(time.Now().Add(writeWait()))
+				if err := s.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+					log.Println(err)
+					s.Close()
+					return
+				}
+			case <-s.Done():
 				return
 			}
 		}